@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Douyin uses aweme_type 68 for image carousel (图文) posts.
+const awemeTypeAlbum = 68
+
+// albumSidecar is the optional album.json placed inside an album folder.
+type albumSidecar struct {
+	Desc  string `json:"desc"`
+	Music string `json:"music"`
+	Cover string `json:"cover"`
+}
+
+var albumImageExts = []string{".jpg", ".jpeg", ".png", ".webp", ".gif"}
+var albumMusicExts = []string{".mp3", ".m4a", ".aac", ".wav"}
+
+func hasExt(name string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isAlbumDir reports whether a folder should be shown as one image album.
+// A folder is an album when it contains an album.json sidecar or when its
+// name ends with ".album".
+func isAlbumDir(dir string) bool {
+	if strings.HasSuffix(strings.ToLower(filepath.Base(dir)), ".album") {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, "album.json"))
+	return err == nil
+}
+
+// scanAlbum builds an aweme object for an album folder. It returns nil if the
+// folder contains no images.
+func scanAlbum(dir string) map[string]interface{} {
+	relPath, err := filepath.Rel(mediaDir, dir)
+	if err != nil {
+		return nil
+	}
+
+	var sidecar albumSidecar
+	if data, err := os.ReadFile(filepath.Join(dir, "album.json")); err == nil {
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			log.Printf("Failed to parse album.json in %s: %v", dir, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var imageNames []string
+	musicName := sidecar.Music
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if hasExt(e.Name(), albumImageExts) {
+			imageNames = append(imageNames, e.Name())
+		} else if musicName == "" && hasExt(e.Name(), albumMusicExts) {
+			musicName = e.Name()
+		}
+	}
+	if len(imageNames) == 0 {
+		return nil
+	}
+	sort.Strings(imageNames)
+
+	id := mediaID(relPath)
+
+	images := make([]map[string]interface{}, 0, len(imageNames))
+	for i, name := range imageNames {
+		width, height := imageSize(filepath.Join(dir, name))
+		imageUrl := mediaURL(filepath.Join(relPath, name))
+		images = append(images, map[string]interface{}{
+			"uri":               fmt.Sprintf("%s_%d", id, i),
+			"url_list":          []string{imageUrl},
+			"download_url_list": []string{imageUrl},
+			"width":             width,
+			"height":            height,
+		})
+	}
+
+	coverUrl := images[0]["url_list"].([]string)[0]
+	if sidecar.Cover != "" {
+		coverUrl = mediaURL(filepath.Join(relPath, sidecar.Cover))
+	}
+
+	desc := sidecar.Desc
+	if desc == "" {
+		desc = filepath.Base(dir)
+		if strings.EqualFold(filepath.Ext(desc), ".album") {
+			desc = strings.TrimSuffix(desc, filepath.Ext(desc))
+		}
+	}
+
+	album := newLocalVideo(id, desc, "", coverUrl)
+	album["aweme_type"] = awemeTypeAlbum
+	album["images"] = images
+
+	video := album["video"].(map[string]interface{})
+	video["play_addr"].(map[string]interface{})["url_list"] = []string{}
+	video["width"] = images[0]["width"]
+	video["height"] = images[0]["height"]
+
+	if musicName != "" {
+		music := album["music"].(map[string]interface{})
+		music["title"] = strings.TrimSuffix(musicName, filepath.Ext(musicName))
+		music["play_url"] = map[string]interface{}{
+			"uri":      id + "_music",
+			"url_list": []string{mediaURL(filepath.Join(relPath, musicName))},
+		}
+	}
+	return album
+}
+
+// imageSize returns the pixel dimensions of an image, or zeros when the format
+// cannot be decoded. WebP is parsed by hand since the standard library has no
+// decoder for it.
+func imageSize(path string) (int, int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".webp" {
+		return webpSize(f)
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+func webpSize(r io.Reader) (int, int) {
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return 0, 0
+	}
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// Lossy: 14-bit dimensions follow the 3-byte frame tag and start code.
+		w := int(binary.LittleEndian.Uint16(header[26:28]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(header[28:30]) & 0x3fff)
+		return w, h
+	case "VP8L":
+		// Lossless: signature byte, then 14 bits each of width-1 and height-1.
+		bits := binary.LittleEndian.Uint32(header[21:25])
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1
+	case "VP8X":
+		// Extended: 24-bit canvas width-1 and height-1.
+		w := int(header[24]) | int(header[25])<<8 | int(header[26])<<16
+		h := int(header[27]) | int(header[28])<<8 | int(header[29])<<16
+		return w + 1, h + 1
+	}
+	return 0, 0
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localUID is the owner of every local video when no accounts are configured.
+const localUID = "local_user"
+
+// account is one entry of the accounts file:
+//
+//	[{"uid": "alice", "nickname": "Alice", "password_hash": "$2a$10$...", "avatar": "", "admin": true}]
+//
+// password_hash is a bcrypt hash, as printed by "douyin hash-password".
+// Admins can see the instance-wide reports under /admin/.
+type account struct {
+	UID          string `json:"uid"`
+	Nickname     string `json:"nickname"`
+	PasswordHash string `json:"password_hash"`
+	// Password is the plaintext field of older accounts files. It is
+	// rejected so passwords are not kept in the clear.
+	Password string `json:"password,omitempty"`
+	Avatar   string `json:"avatar"`
+	Admin    bool   `json:"admin,omitempty"`
+}
+
+var accountsPath string
+var accounts map[string]*account
+
+// sessions maps login tokens to uids and is persisted as state/sessions.json
+// so logins survive a restart.
+var sessions = make(map[string]string)
+var sessionsMu sync.Mutex
+
+func loadAccounts() {
+	accounts = make(map[string]*account)
+	data, err := os.ReadFile(accountsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read accounts: %v", err)
+		}
+		log.Printf("No accounts configured, running in single-user mode as %s", localUID)
+		return
+	}
+	var list []*account
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Failed to parse accounts: %v", err)
+		return
+	}
+	for _, a := range list {
+		if a.UID == "" {
+			continue
+		}
+		if a.PasswordHash == "" && a.Password != "" {
+			log.Printf("Account %s has a plaintext password; replace it with a password_hash from hash-password", a.UID)
+		}
+		a.Password = ""
+		if a.Nickname == "" {
+			a.Nickname = a.UID
+		}
+		accounts[a.UID] = a
+	}
+	log.Printf("Loaded %d accounts", len(accounts))
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if err := loadState("sessions", &sessions); err != nil {
+		log.Printf("Failed to load sessions: %v", err)
+	}
+}
+
+// requestToken finds the login token in the Authorization header, the token
+// cookie or the token query parameter. The latter two let <video> tags and
+// WebSocket connections authenticate.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := r.Cookie("token"); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// requestUser returns the account logged in on this request, or nil.
+func requestUser(r *http.Request) *account {
+	token := requestToken(r)
+	if token == "" {
+		return nil
+	}
+	sessionsMu.Lock()
+	uid, ok := sessions[token]
+	sessionsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return accounts[uid]
+}
+
+// requestUID returns the uid acting on this request. In single-user mode
+// every request acts as localUID; otherwise an empty string means the client
+// is not logged in.
+func requestUID(r *http.Request) string {
+	if len(accounts) == 0 {
+		return localUID
+	}
+	if a := requestUser(r); a != nil {
+		return a.UID
+	}
+	return ""
+}
+
+// knownUser reports whether uid belongs to a user of this instance.
+func knownUser(uid string) bool {
+	if len(accounts) == 0 {
+		return uid == localUID
+	}
+	_, ok := accounts[uid]
+	return ok
+}
+
+// accountAuthor returns the author object shown for a uid, using the
+// account's nickname and avatar when there is one.
+func accountAuthor(uid string) map[string]interface{} {
+	if a, ok := accounts[uid]; ok {
+		return newLocalAuthor(a.UID, a.Nickname, a.Avatar)
+	}
+	if uid == localUID {
+		return newLocalAuthor(localUID, "Local User", "")
+	}
+	return newLocalAuthor(uid, uid, "")
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	finalResp := map[string]interface{}{
+		"code": 401,
+		"msg":  "Not logged in",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// dummyPasswordHash is compared against when the uid is unknown.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("douyin"), bcrypt.DefaultCost)
+
+func userLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var req struct {
+		UID      string `json:"uid"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a, ok := accounts[req.UID]
+	hash := dummyPasswordHash
+	if ok && a.PasswordHash != "" {
+		hash = []byte(a.PasswordHash)
+	}
+	// Compare even for unknown uids, so timing does not reveal them
+	err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password))
+	if !ok || a.PasswordHash == "" || err != nil {
+		finalResp := map[string]interface{}{
+			"code": 401,
+			"msg":  "Invalid uid or password",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	sessionsMu.Lock()
+	sessions[token] = a.UID
+	err = saveState("sessions", sessions)
+	sessionsMu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save sessions: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"token": token,
+			"user":  accountAuthor(a.UID),
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if token := requestToken(r); token != "" {
+		sessionsMu.Lock()
+		delete(sessions, token)
+		err := saveState("sessions", sessions)
+		sessionsMu.Unlock()
+		if err != nil {
+			log.Printf("Failed to save sessions: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: "", Path: "/", MaxAge: -1})
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// runHashPassword implements the hash-password subcommand, which prints the
+// password_hash for a password read from stdin:
+//
+//	echo -n secret | douyin hash-password
+func runHashPassword(args []string) {
+	fset := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := fset.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: douyin hash-password [--cost n] < password")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, 1024))
+	if err != nil {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		log.Fatalf("Empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	if err != nil {
+		log.Fatalf("Failed to hash password: %v", err)
+	}
+	fmt.Println(string(hash))
+}
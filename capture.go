@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When and where a video was shot. The probe reads, from MP4/MOV files, the
+// com.apple.quicktime.creationdate and location keys of moov/meta, the ©xyz
+// atom of udta and the mvhd creation time; from Matroska, the DateUTC of the
+// segment info. Scanned videos get create_time from them, else from the
+// file's mtime, and a poi_info object when there is a location.
+
+type geoLocation struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// Epochs of the MP4 and Matroska date fields.
+var (
+	mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	mkvEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// plausibleCaptureTime rejects the zero dates many encoders write.
+func plausibleCaptureTime(t time.Time) bool {
+	return t.Year() >= 1990 && t.Before(time.Now().Add(48*time.Hour))
+}
+
+// parseMvhdCreation returns the creation time of an mvhd box.
+func parseMvhdCreation(data []byte) time.Time {
+	var seconds uint64
+	if len(data) >= 12 && data[0] == 1 {
+		seconds = binary.BigEndian.Uint64(data[4:12])
+	} else if len(data) >= 8 {
+		seconds = uint64(binary.BigEndian.Uint32(data[4:8]))
+	}
+	if seconds == 0 || seconds > math.MaxInt32*4 {
+		return time.Time{}
+	}
+	return mp4Epoch.Add(time.Duration(seconds) * time.Second)
+}
+
+// readMP4Capture fills in the capture time and location of a probe from the
+// metadata in moov.
+func readMP4Capture(r io.ReaderAt, moov mp4Box, children []mp4Box, probe *mediaProbe) {
+	keys := readQuickTimeKeys(r, children)
+	if date := keys["com.apple.quicktime.creationdate"]; date != "" {
+		if t, ok := parseCaptureDate(date); ok {
+			probe.CaptureTime = t
+		}
+	}
+	if loc := parseISO6709(keys["com.apple.quicktime.location.ISO6709"]); loc != nil {
+		probe.Location = loc
+	}
+
+	if probe.Location == nil {
+		if xyz, ok := mp4Path(r, moov, "udta", "\xa9xyz"); ok {
+			// A 16-bit length and language, then the text
+			if data, err := readMP4BoxData(r, xyz, 1024); err == nil && len(data) > 4 {
+				probe.Location = parseISO6709(string(data[4:]))
+			}
+		}
+	}
+
+	if probe.CaptureTime.IsZero() {
+		if mvhd, ok := findMP4Box(children, "mvhd"); ok {
+			if data, err := readMP4BoxData(r, mvhd, 1024); err == nil {
+				probe.CaptureTime = parseMvhdCreation(data)
+			}
+		}
+	}
+	if !plausibleCaptureTime(probe.CaptureTime) {
+		probe.CaptureTime = time.Time{}
+	}
+}
+
+// readQuickTimeKeys reads the string values of the QuickTime metadata in
+// moov/meta: a keys box naming the items of the ilst box by index.
+func readQuickTimeKeys(r io.ReaderAt, children []mp4Box) map[string]string {
+	values := make(map[string]string)
+	meta, ok := findMP4Box(children, "meta")
+	if !ok {
+		return values
+	}
+	items, err := mp4Children(r, meta)
+	if err != nil || len(items) == 0 || items[0].typ != "hdlr" {
+		// MP4-style meta is a full box: skip its version and flags
+		items, _ = readMP4Boxes(r, meta.dataOffset()+4, meta.end())
+	}
+	keysBox, ok := findMP4Box(items, "keys")
+	if !ok {
+		return values
+	}
+	ilst, ok := findMP4Box(items, "ilst")
+	if !ok {
+		return values
+	}
+	data, err := readMP4BoxData(r, keysBox, 1<<16)
+	if err != nil || len(data) < 8 {
+		return values
+	}
+	// version/flags, count, then size + namespace + name per key
+	var names []string
+	for off := 8; off+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[off:]))
+		if size < 8 || off+size > len(data) {
+			break
+		}
+		names = append(names, string(data[off+8:off+size]))
+		off += size
+	}
+
+	entries, _ := mp4Children(r, ilst)
+	for _, e := range entries {
+		index := int(binary.BigEndian.Uint32([]byte(e.typ)))
+		if index < 1 || index > len(names) {
+			continue
+		}
+		dataBox, ok := mp4Path(r, e, "data")
+		if !ok {
+			continue
+		}
+		// type indicator and locale, then the value; type 1 is UTF-8
+		value, err := readMP4BoxData(r, dataBox, 4096)
+		if err != nil || len(value) < 8 || binary.BigEndian.Uint32(value) != 1 {
+			continue
+		}
+		values[names[index-1]] = string(value[8:])
+	}
+	return values
+}
+
+// parseCaptureDate parses the ISO 8601 dates of QuickTime metadata, such as
+// 2023-08-10T14:22:31+0800.
+func parseCaptureDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// iso6709 matches decimal-degree locations like +37.3349-122.0090+010.000/.
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+func parseISO6709(s string) *geoLocation {
+	m := iso6709.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil
+	}
+	lat, err1 := strconv.ParseFloat(m[1], 64)
+	lng, err2 := strconv.ParseFloat(m[2], 64)
+	if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lng) > 180 {
+		return nil
+	}
+	loc := &geoLocation{Latitude: lat, Longitude: lng}
+	if m[3] != "" {
+		loc.Altitude, _ = strconv.ParseFloat(m[3], 64)
+	}
+	return loc
+}
+
+// applyCapture sets create_time to when a video was shot, or to its file's
+// mtime, and adds poi_info for videos with a location. Metadata applied
+// later (upload records, info.json, NFO) may still override create_time.
+func applyCapture(video map[string]interface{}, path string) {
+	probe := probeMedia(path)
+	if probe != nil && !probe.CaptureTime.IsZero() {
+		video["create_time"] = probe.CaptureTime.Unix()
+	} else if info, err := os.Stat(path); err == nil {
+		video["create_time"] = info.ModTime().Unix()
+	}
+
+	if probe == nil || probe.Location == nil {
+		return
+	}
+	loc := probe.Location
+	video["poi_info"] = map[string]interface{}{
+		"poi_id":    fmt.Sprintf("%.5f,%.5f", loc.Latitude, loc.Longitude),
+		"poi_name":  formatCoordinates(loc),
+		"latitude":  loc.Latitude,
+		"longitude": loc.Longitude,
+		"altitude":  loc.Altitude,
+	}
+}
+
+// formatCoordinates writes a location as 37.33490°N 122.00900°W.
+func formatCoordinates(loc *geoLocation) string {
+	ns, ew := "N", "E"
+	if loc.Latitude < 0 {
+		ns = "S"
+	}
+	if loc.Longitude < 0 {
+		ew = "W"
+	}
+	return fmt.Sprintf("%.5f°%s %.5f°%s", math.Abs(loc.Latitude), ns, math.Abs(loc.Longitude), ew)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Ownership and metadata of local videos, persisted as state/catalog.json. A
+// video belongs to the uid in its record, else to the account named by the
+// first folder of its path (media/<uid>/... or media/private/<uid>/...). In
+// single-user mode every local video belongs to localUID.
+
+type catalogRecord struct {
+	Owner string `json:"owner"`
+	// Metadata entered when the video was uploaded
+	Desc       string   `json:"desc,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Music      string   `json:"music,omitempty"`
+	CreateTime int64    `json:"create_time,omitempty"`
+	// PinTime is when the owner pinned the video to their profile, 0 if not
+	// pinned.
+	PinTime int64 `json:"pin_time,omitempty"`
+	// Codecs of the file, as read by the scanner
+	VideoCodec string `json:"video_codec,omitempty"`
+	AudioCodec string `json:"audio_codec,omitempty"`
+	// MoovAtEnd marks MP4s that need a faststart rewrite
+	MoovAtEnd bool `json:"moov_at_end,omitempty"`
+}
+
+var catalog = make(map[string]*catalogRecord)
+var catalogMu sync.Mutex
+
+func loadCatalogState() {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	if err := loadState("catalog", &catalog); err != nil {
+		log.Printf("Failed to load catalog: %v", err)
+	}
+	if catalog == nil {
+		catalog = make(map[string]*catalogRecord)
+	}
+}
+
+// saveCatalogState must be called with catalogMu held.
+func saveCatalogState() {
+	if err := saveState("catalog", catalog); err != nil {
+		log.Printf("Failed to save catalog: %v", err)
+	}
+}
+
+// mediaOwner returns the uid owning the local video id stored at path.
+func mediaOwner(id, path string) string {
+	catalogMu.Lock()
+	rec := catalog[id]
+	catalogMu.Unlock()
+	return recordOwner(rec, path)
+}
+
+// recordOwner is mediaOwner for a catalog record that has already been
+// looked up; rec may be nil. It does not lock catalogMu.
+func recordOwner(rec *catalogRecord, path string) string {
+	if rec != nil && rec.Owner != "" {
+		return rec.Owner
+	}
+	if rel, err := filepath.Rel(mediaDir, path); err == nil {
+		if owner, ok := privateOwner(filepath.ToSlash(rel)); ok {
+			return owner
+		}
+		first := strings.Split(filepath.ToSlash(rel), "/")[0]
+		if first != rel && len(accounts) > 0 && knownUser(first) {
+			return first
+		}
+	}
+	if len(accounts) == 0 {
+		return localUID
+	}
+	return ""
+}
+
+// applyCatalogRecord shows the owning account as the author of a video and
+// applies the metadata entered on upload. Metadata files applied afterwards
+// may still override them.
+func applyCatalogRecord(video map[string]interface{}, id, path string) {
+	if owner := mediaOwner(id, path); owner != "" && len(accounts) > 0 {
+		video["author"] = accountAuthor(owner)
+	}
+
+	catalogMu.Lock()
+	rec := catalog[id]
+	catalogMu.Unlock()
+	if rec == nil {
+		return
+	}
+	if rec.Desc != "" {
+		video["desc"] = rec.Desc
+	}
+	if rec.CreateTime > 0 {
+		video["create_time"] = rec.CreateTime
+	}
+	if len(rec.Tags) > 0 {
+		textExtra := make([]map[string]interface{}, 0, len(rec.Tags))
+		for _, tag := range rec.Tags {
+			textExtra = append(textExtra, map[string]interface{}{
+				"type":         1,
+				"hashtag_name": tag,
+			})
+		}
+		video["text_extra"] = textExtra
+	}
+	if rec.Music != "" {
+		if music, ok := video["music"].(map[string]interface{}); ok {
+			music["title"] = musicTitle(rec.Music)
+		}
+	}
+}
+
+// musicTitle resolves a music id from music.json to its title. Anything else
+// is taken as the title itself.
+func musicTitle(music string) string {
+	for _, m := range jsonMusic {
+		if idString(m["id"]) != music {
+			continue
+		}
+		for _, key := range []string{"title", "name"} {
+			if title, ok := m[key].(string); ok && title != "" {
+				return title
+			}
+		}
+	}
+	return music
+}
+
+// pinTime returns when a video was pinned, 0 if it is not.
+func pinTime(id string) int64 {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	if rec := catalog[id]; rec != nil {
+		return rec.PinTime
+	}
+	return 0
+}
+
+// ownedVideos lists the local videos of uid, including their private ones
+// when withPrivate is set.
+func ownedVideos(uid string, withPrivate bool) []map[string]interface{} {
+	var owned []map[string]interface{}
+	if videos, err := scanMediaVideos(); err == nil {
+		for _, v := range videos {
+			id, _ := v["aweme_id"].(string)
+			if path, ok := knownMediaPath(id); ok && mediaOwner(id, path) == uid {
+				owned = append(owned, v)
+			}
+		}
+	}
+	if !withPrivate {
+		return owned
+	}
+	if private, err := privateVideos(uid); err == nil {
+		owned = append(owned, private...)
+	}
+	return owned
+}
+
+// Sort orders accepted by the profile video lists.
+const (
+	sortNewest = "newest"
+	sortOldest = "oldest"
+	sortViews  = "views"
+	sortPinned = "pinned"
+)
+
+// sortVideos orders videos newest or oldest first, by play count, or pinned
+// first (most recently pinned first, then newest). Pinned first is the
+// default, as on a Douyin profile.
+func sortVideos(videos []map[string]interface{}, order string) {
+	newer := func(i, j int) bool {
+		return toInt(videos[i]["create_time"]) > toInt(videos[j]["create_time"])
+	}
+	switch order {
+	case sortNewest:
+		sort.SliceStable(videos, newer)
+	case sortOldest:
+		sort.SliceStable(videos, func(i, j int) bool { return newer(j, i) })
+	case sortViews:
+		sort.SliceStable(videos, func(i, j int) bool {
+			vi, vj := playCount(videos[i]), playCount(videos[j])
+			if vi != vj {
+				return vi > vj
+			}
+			return newer(i, j)
+		})
+	default:
+		pins := make(map[string]int64)
+		for _, v := range videos {
+			id := idString(v["aweme_id"])
+			pins[id] = pinTime(id)
+		}
+		sort.SliceStable(videos, func(i, j int) bool {
+			pi, pj := pins[idString(videos[i]["aweme_id"])], pins[idString(videos[j]["aweme_id"])]
+			if pi != pj {
+				return pi > pj
+			}
+			return newer(i, j)
+		})
+	}
+}
+
+func playCount(video map[string]interface{}) int {
+	if stats, ok := video["statistics"].(map[string]interface{}); ok {
+		return toInt(stats["play_count"])
+	}
+	return 0
+}
+
+// recordProbe keeps what the scanner read from a file's headers in its
+// catalog record, for tools reading catalog.json. Feeds use the cached probe
+// itself; the record is only written when the values change, and an owner-less
+// record still belongs to whoever owns the file (see recordOwner).
+func recordProbe(id string, probe *mediaProbe) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	rec := catalog[id]
+	if rec == nil {
+		if probe.VideoCodec == "" && probe.AudioCodec == "" && !probe.MoovAtEnd {
+			return
+		}
+		rec = &catalogRecord{}
+		catalog[id] = rec
+	}
+	if rec.VideoCodec == probe.VideoCodec && rec.AudioCodec == probe.AudioCodec && rec.MoovAtEnd == probe.MoovAtEnd {
+		return
+	}
+	rec.VideoCodec, rec.AudioCodec = probe.VideoCodec, probe.AudioCodec
+	rec.MoovAtEnd = probe.MoovAtEnd
+	saveCatalogState()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Chapters of local videos, shown as a chapters array with times in
+// milliseconds. They come from, in order of preference:
+//
+//   - <video>.chapters.txt next to the video, or chapters.txt when the video
+//     is alone in its folder, one "00:01:23 Title" per line
+//   - MP4 Nero chapters (moov/udta/chpl)
+//   - a QuickTime chapter track (a text track referenced by tref/chap)
+//   - Matroska Chapters
+
+type chapter struct {
+	Title     string  `json:"title"`
+	StartTime int     `json:"start_time"`
+	EndTime   int     `json:"end_time"`
+	start     float64 // seconds
+}
+
+var chapterCache, chapterTextCache sidecarCache
+
+// applyChapters adds the chapters array to a scanned video.
+func applyChapters(video map[string]interface{}, path string) {
+	var chapters []chapter
+	for _, p := range chapterTextPaths(path) {
+		if c, _ := chapterTextCache.load(p, parseChapterText).([]chapter); len(c) > 0 {
+			chapters = c
+			break
+		}
+	}
+	if chapters == nil {
+		chapters, _ = chapterCache.load(path, readContainerChapters).([]chapter)
+	}
+	if len(chapters) == 0 {
+		return
+	}
+
+	duration := float64(videoDurationMs(video)) / 1000
+	list := make([]chapter, 0, len(chapters))
+	for _, c := range chapters {
+		// Sidecars may be meant for another cut of the video
+		if duration <= 0 || c.start < duration {
+			list = append(list, c)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].start < list[j].start })
+	for i := range list {
+		end := duration
+		if i+1 < len(list) {
+			end = list[i+1].start
+		}
+		list[i].StartTime = int(math.Round(list[i].start * 1000))
+		list[i].EndTime = int(math.Round(math.Max(end, list[i].start) * 1000))
+	}
+	if len(list) > 0 {
+		video["chapters"] = list
+	}
+}
+
+// chapterTextPaths lists the chapter files that may belong to a video. A
+// plain chapters.txt only counts when the video is alone in its folder.
+func chapterTextPaths(path string) []string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	paths := []string{base + ".chapters.txt"}
+	if onlyVideoInDir(path) {
+		paths = append(paths, filepath.Join(filepath.Dir(path), "chapters.txt"))
+	}
+	return paths
+}
+
+// chapterLine matches "1:23 Title", "00:01:23.5 - Title" and the like.
+var chapterLine = regexp.MustCompile(`^(?:(\d+):)?(\d{1,2}):(\d{1,2}(?:[.,]\d+)?)\s*(?:[-–—:|]\s*)?(.*)$`)
+
+func parseChapterText(path string) (interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chapters []chapter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		m := chapterLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		hours, _ := strconv.Atoi(m[1])
+		minutes, _ := strconv.Atoi(m[2])
+		seconds, _ := strconv.ParseFloat(strings.Replace(m[3], ",", ".", 1), 64)
+		chapters = append(chapters, chapter{
+			Title: strings.TrimSpace(m[4]),
+			start: float64(hours*3600+minutes*60) + seconds,
+		})
+	}
+	return chapters, scanner.Err()
+}
+
+// readContainerChapters reads the chapters stored in a video file.
+func readContainerChapters(path string) (interface{}, error) {
+	format := mediaFormatFor(path)
+	if format == nil {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	switch format.Container {
+	case "mp4":
+		return readMP4Chapters(f, stat.Size())
+	case "webm":
+		return readMatroskaChapters(f, stat.Size())
+	}
+	return nil, nil
+}
+
+func readMP4Chapters(r io.ReaderAt, size int64) ([]chapter, error) {
+	top, err := readMP4Boxes(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return nil, errNoMoov
+	}
+	if chpl, ok := mp4Path(r, moov, "udta", "chpl"); ok {
+		data, err := readMP4BoxData(r, chpl, 1<<20)
+		if err == nil {
+			if chapters := parseChpl(data); len(chapters) > 0 {
+				return chapters, nil
+			}
+		}
+	}
+
+	// QuickTime: a track referencing its chapter track with tref/chap
+	children, err := mp4Children(r, moov)
+	if err != nil {
+		return nil, err
+	}
+	var chapterIDs []uint32
+	var traks []mp4Box
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		traks = append(traks, trak)
+		if chap, ok := mp4Path(r, trak, "tref", "chap"); ok {
+			data, err := readMP4BoxData(r, chap, 1024)
+			if err != nil {
+				continue
+			}
+			for i := 0; i+4 <= len(data); i += 4 {
+				chapterIDs = append(chapterIDs, binary.BigEndian.Uint32(data[i:]))
+			}
+		}
+	}
+	if len(chapterIDs) == 0 {
+		return nil, nil
+	}
+	for _, trak := range traks {
+		if mp4TrackID(r, trak) != chapterIDs[0] {
+			continue
+		}
+		t, err := readMP4Track(r, trak)
+		if err != nil || t.timescale == 0 {
+			continue
+		}
+		var chapters []chapter
+		for _, s := range t.samples {
+			if s.size < 2 || s.size > 4096 {
+				continue
+			}
+			data := make([]byte, s.size)
+			if _, err := r.ReadAt(data, s.offset); err != nil {
+				continue
+			}
+			// A 16-bit length, then the text
+			n := int(binary.BigEndian.Uint16(data))
+			if 2+n > len(data) {
+				continue
+			}
+			chapters = append(chapters, chapter{
+				Title: decodeChapterTitle(data[2 : 2+n]),
+				start: float64(s.dts) / float64(t.timescale),
+			})
+		}
+		return chapters, nil
+	}
+	return nil, nil
+}
+
+// parseChpl parses a Nero chapter list: version and flags, 4 reserved bytes
+// in version 1, a count, then per chapter a start time in 100ns units and a
+// length-prefixed title.
+func parseChpl(data []byte) []chapter {
+	if len(data) < 5 {
+		return nil
+	}
+	off := 4
+	if data[0] == 1 {
+		off += 4
+	}
+	if off >= len(data) {
+		return nil
+	}
+	count := int(data[off])
+	off++
+	var chapters []chapter
+	for i := 0; i < count && off+9 <= len(data); i++ {
+		start := binary.BigEndian.Uint64(data[off:])
+		n := int(data[off+8])
+		off += 9
+		if off+n > len(data) {
+			break
+		}
+		chapters = append(chapters, chapter{
+			Title: strings.TrimSpace(string(data[off : off+n])),
+			start: float64(start) / 1e7,
+		})
+		off += n
+	}
+	return chapters
+}
+
+// decodeChapterTitle decodes QuickTime text, which is UTF-16 when it starts
+// with a byte order mark and UTF-8 otherwise.
+func decodeChapterTitle(data []byte) string {
+	if len(data) >= 2 && (data[0] == 0xFE && data[1] == 0xFF || data[0] == 0xFF && data[1] == 0xFE) {
+		order := binary.ByteOrder(binary.BigEndian)
+		if data[0] == 0xFF {
+			order = binary.LittleEndian
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 2; i+2 <= len(data); i += 2 {
+			units = append(units, order.Uint16(data[i:]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Matroska chapter elements.
+const (
+	mkvChapters          = 0x1043A770
+	mkvEditionEntry      = 0x45B9
+	mkvChapterAtom       = 0xB6
+	mkvChapterTimeStart  = 0x91
+	mkvChapterFlagHidden = 0x98
+	mkvChapterDisplay    = 0x80
+	mkvChapString        = 0x85
+)
+
+// readMatroskaChapters reads the chapters of the first edition. Like the
+// probe, it only looks at the elements before the first Cluster.
+func readMatroskaChapters(r io.ReaderAt, size int64) ([]chapter, error) {
+	top, err := readEBMLElements(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	for _, segment := range top {
+		if segment.id != mkvSegment {
+			continue
+		}
+		children, _ := readEBMLElements(r, segment.offset, segment.offset+segment.size)
+		for _, e := range children {
+			if e.id != mkvChapters {
+				continue
+			}
+			editions, _ := readEBMLElements(r, e.offset, e.offset+e.size)
+			for _, edition := range editions {
+				if edition.id == mkvEditionEntry {
+					return readMatroskaEdition(r, edition), nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func readMatroskaEdition(r io.ReaderAt, edition ebmlElement) []chapter {
+	var chapters []chapter
+	atoms, _ := readEBMLElements(r, edition.offset, edition.offset+edition.size)
+	for _, atom := range atoms {
+		if atom.id != mkvChapterAtom {
+			continue
+		}
+		var c chapter
+		hidden := false
+		fields, _ := readEBMLElements(r, atom.offset, atom.offset+atom.size)
+		for _, f := range fields {
+			switch f.id {
+			case mkvChapterTimeStart:
+				data, _ := readEBMLData(r, f)
+				c.start = float64(ebmlUint(data)) / 1e9
+			case mkvChapterFlagHidden:
+				data, _ := readEBMLData(r, f)
+				hidden = ebmlUint(data) == 1
+			case mkvChapterDisplay:
+				if c.Title != "" {
+					continue
+				}
+				display, _ := readEBMLElements(r, f.offset, f.offset+f.size)
+				for _, d := range display {
+					if d.id == mkvChapString {
+						data, _ := readEBMLData(r, d)
+						c.Title = strings.TrimSpace(string(data))
+					}
+				}
+			}
+		}
+		if !hidden {
+			chapters = append(chapters, c)
+		}
+	}
+	return chapters
+}
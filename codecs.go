@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Codec compatibility. The probe reads the video and audio codec of each
+// local video, which is recorded in the catalog and shown as
+// video.video_codec / video.audio_codec. Feeds then leave out, or switch to a
+// transcoded rendition, the videos a client cannot play: VP9 WebMs on iOS
+// Safari, HEVC on most desktop browsers, and so on.
+//
+// Clients state what they play with ?codecs=avc1,mp4a or an X-Accept-Codecs
+// header; otherwise it is guessed from the User-Agent. Unknown clients get
+// everything.
+
+// codecFamily maps MP4 sample entry types to one name per codec.
+func codecFamily(fourCC string) string {
+	switch fourCC {
+	case "avc1", "avc3":
+		return "avc1"
+	case "hvc1", "hev1":
+		return "hvc1"
+	case "vp08", "vp09", "av01", "mp4a", "ac-3", "ec-3", "alac":
+		return fourCC
+	case "Opus":
+		return "opus"
+	case "fLaC":
+		return "flac"
+	}
+	return strings.TrimSpace(fourCC)
+}
+
+// matroskaCodec maps Matroska CodecIDs to the names used for MP4.
+func matroskaCodec(codecID string) string {
+	switch {
+	case codecID == "V_VP8":
+		return "vp08"
+	case codecID == "V_VP9":
+		return "vp09"
+	case codecID == "V_AV1":
+		return "av01"
+	case codecID == "V_MPEG4/ISO/AVC":
+		return "avc1"
+	case codecID == "V_MPEGH/ISO/HEVC":
+		return "hvc1"
+	case codecID == "A_OPUS":
+		return "opus"
+	case codecID == "A_VORBIS":
+		return "vorbis"
+	case strings.HasPrefix(codecID, "A_AAC"):
+		return "mp4a"
+	case codecID == "A_AC3":
+		return "ac-3"
+	case codecID == "A_EAC3":
+		return "ec-3"
+	case codecID == "A_FLAC":
+		return "flac"
+	}
+	return strings.ToLower(codecID)
+}
+
+// applyCodecs shows the codecs of a scanned video and records them in its
+// catalog record. Filtering reads them from the video, not the catalog.
+func applyCodecs(video map[string]interface{}, id, path string) {
+	probe := probeMedia(path)
+	if probe == nil || probe.VideoCodec == "" && probe.AudioCodec == "" {
+		return
+	}
+	if v, ok := video["video"].(map[string]interface{}); ok {
+		v["video_codec"] = probe.VideoCodec
+		v["audio_codec"] = probe.AudioCodec
+	}
+	recordProbe(id, probe)
+}
+
+// Codecs played by each browser family in <video>, kept to what works on
+// all current versions.
+var (
+	appleCodecs    = []string{"avc1", "hvc1", "mp4a", "ac-3", "ec-3", "alac", "flac"}
+	chromeCodecs   = []string{"avc1", "vp08", "vp09", "av01", "mp4a", "opus", "vorbis", "flac"}
+	firefoxCodecs  = []string{"avc1", "vp08", "vp09", "av01", "mp4a", "opus", "vorbis", "flac"}
+	renditionCodec = []string{"avc1", "mp4a"}
+)
+
+// clientCodecs returns the codecs a request's client can play, or nil when
+// that is unknown.
+func clientCodecs(r *http.Request) map[string]bool {
+	var list []string
+	hint := r.URL.Query().Get("codecs")
+	if hint == "" {
+		hint = r.Header.Get("X-Accept-Codecs")
+	}
+	if hint != "" {
+		for _, c := range strings.FieldsFunc(hint, func(r rune) bool { return r == ',' || r == ' ' }) {
+			// Full codec strings such as avc1.640028 name their family first
+			family, _, _ := strings.Cut(c, ".")
+			list = append(list, codecFamily(family))
+		}
+	} else {
+		ua := r.UserAgent()
+		switch {
+		case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+			// Every browser on iOS uses WebKit
+			list = appleCodecs
+		case strings.Contains(ua, "Firefox/"):
+			list = firefoxCodecs
+		case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "Chromium/") || strings.Contains(ua, "Edg/"):
+			list = chromeCodecs
+		case strings.Contains(ua, "Safari/") && strings.Contains(ua, "Macintosh"):
+			list = appleCodecs
+		default:
+			return nil
+		}
+	}
+	codecs := make(map[string]bool, len(list))
+	for _, c := range list {
+		codecs[c] = true
+	}
+	return codecs
+}
+
+// playable reports whether a client plays the given codecs. Unknown codecs
+// are assumed to play.
+func playable(codecs map[string]bool, videoCodec, audioCodec string) bool {
+	return codecs == nil ||
+		(videoCodec == "" || codecs[videoCodec]) && (audioCodec == "" || codecs[audioCodec])
+}
+
+// adaptForClient returns the videos a client can play. Videos in a codec it
+// cannot play switch to their best transcoded rendition, or are left out when
+// there is none.
+func adaptForClient(videos []map[string]interface{}, codecs map[string]bool) []map[string]interface{} {
+	if codecs == nil {
+		return videos
+	}
+	renditionsPlay := playable(codecs, renditionCodec[0], renditionCodec[1])
+	adapted := make([]map[string]interface{}, 0, len(videos))
+	for _, video := range videos {
+		v, ok := video["video"].(map[string]interface{})
+		if !ok {
+			adapted = append(adapted, video)
+			continue
+		}
+		videoCodec, _ := v["video_codec"].(string)
+		audioCodec, _ := v["audio_codec"].(string)
+		if playable(codecs, videoCodec, audioCodec) {
+			adapted = append(adapted, video)
+			continue
+		}
+		bitRates, _ := v["bit_rate"].([]map[string]interface{})
+		if !renditionsPlay || len(bitRates) == 0 {
+			continue
+		}
+		// bit_rate lists the best rendition first
+		v["play_addr"] = bitRates[0]["play_addr"]
+		v["video_codec"], v["audio_codec"] = renditionCodec[0], renditionCodec[1]
+		// The HLS playlist repackages the original streams
+		delete(v, "play_addr_hls")
+		adapted = append(adapted, video)
+	}
+	return adapted
+}
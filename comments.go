@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Comments posted on this instance, persisted per video in
+// state/comments.json and served by videoCommentsHandler ahead of the mock
+// comments. Bullet comments (danmaku) are stored in the same entry.
+
+type localComment struct {
+	CommentID  string `json:"comment_id"`
+	AwemeID    string `json:"aweme_id"`
+	UID        string `json:"uid"`
+	Content    string `json:"content"`
+	ReplyID    string `json:"reply_id,omitempty"`
+	CreateTime int64  `json:"create_time"`
+}
+
+type videoComments struct {
+	Comments []*localComment `json:"comments"`
+	Danmaku  []*danmaku      `json:"danmaku,omitempty"`
+	// Imported maps danmaku files already imported to their mtime.
+	Imported map[string]int64 `json:"imported,omitempty"`
+}
+
+var commentStore = make(map[string]*videoComments)
+var commentsMu sync.Mutex
+
+var mentionPattern = regexp.MustCompile(`@([^\s@]+)`)
+
+func loadCommentState() {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	if err := loadState("comments", &commentStore); err != nil {
+		log.Printf("Failed to load comments: %v", err)
+	}
+	if commentStore == nil {
+		commentStore = make(map[string]*videoComments)
+	}
+}
+
+// saveCommentState must be called with commentsMu held.
+func saveCommentState() {
+	if err := saveState("comments", commentStore); err != nil {
+		log.Printf("Failed to save comments: %v", err)
+	}
+}
+
+// videoCommentsFor returns the stored entry of a video, creating it when
+// create is set. It must be called with commentsMu held.
+func videoCommentsFor(awemeID string, create bool) *videoComments {
+	vc := commentStore[awemeID]
+	if vc == nil && create {
+		vc = &videoComments{}
+		commentStore[awemeID] = vc
+	}
+	return vc
+}
+
+func commentCounts() map[string]int {
+	counts := make(map[string]int)
+	commentsMu.Lock()
+	for id, vc := range commentStore {
+		counts[id] = len(vc.Comments)
+	}
+	commentsMu.Unlock()
+	return counts
+}
+
+// mentionedUIDs resolves "@uid" and "@nickname" mentions to users of this
+// instance.
+func mentionedUIDs(text string) []string {
+	seen := make(map[string]bool)
+	var uids []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(m[1], ",.!?;:，。！？；：")
+		uid := ""
+		if knownUser(name) {
+			uid = name
+		} else {
+			for _, a := range accounts {
+				if a.Nickname == name {
+					uid = a.UID
+					break
+				}
+			}
+		}
+		if uid != "" && !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// commentView renders a local comment in the shape of the mock comment files.
+func commentView(c *localComment) map[string]interface{} {
+	author := accountAuthor(c.UID)
+	avatar := ""
+	if thumb, ok := author["avatar_thumb"].(map[string]interface{}); ok {
+		if urls, ok := thumb["url_list"].([]string); ok && len(urls) > 0 {
+			avatar = urls[0]
+		}
+	}
+	return map[string]interface{}{
+		"comment_id":        c.CommentID,
+		"create_time":       c.CreateTime,
+		"ip_location":       "",
+		"aweme_id":          c.AwemeID,
+		"content":           c.Content,
+		"reply_id":          c.ReplyID,
+		"is_author_digged":  false,
+		"is_folded":         false,
+		"is_hot":            false,
+		"user_buried":       false,
+		"user_digged":       0,
+		"digg_count":        0,
+		"user_id":           c.UID,
+		"sec_uid":           c.UID,
+		"short_user_id":     c.UID,
+		"user_unique_id":    author["unique_id"],
+		"user_signature":    "",
+		"nickname":          author["nickname"],
+		"avatar":            avatar,
+		"sub_comment_count": 0,
+		"last_modify_ts":    c.CreateTime,
+	}
+}
+
+// localCommentsView returns the local comments of a video, newest first.
+func localCommentsView(awemeID string) []interface{} {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	vc := videoCommentsFor(awemeID, false)
+	if vc == nil {
+		return nil
+	}
+	list := make([]interface{}, 0, len(vc.Comments))
+	for i := len(vc.Comments) - 1; i >= 0; i-- {
+		list = append(list, commentView(vc.Comments[i]))
+	}
+	return list
+}
+
+// videoCommentAddHandler posts a comment and notifies the video's author and
+// every mentioned user.
+func videoCommentAddHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		AwemeID string `json:"aweme_id"`
+		Content string `json:"content"`
+		ReplyID string `json:"reply_id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil || strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	video := findVideo(req.AwemeID)
+	if video == nil {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Video not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	c := &localComment{
+		CommentID:  hex.EncodeToString(buf),
+		AwemeID:    req.AwemeID,
+		UID:        uid,
+		Content:    req.Content,
+		ReplyID:    req.ReplyID,
+		CreateTime: time.Now().Unix(),
+	}
+
+	commentsMu.Lock()
+	vc := videoCommentsFor(req.AwemeID, true)
+	vc.Comments = append(vc.Comments, c)
+	saveCommentState()
+	commentsMu.Unlock()
+
+	owner := videoOwner(video)
+	addNotice(notice{UID: owner, Type: noticeComment, FromUID: uid, AwemeID: c.AwemeID, CommentID: c.CommentID, Content: c.Content})
+	for _, mentioned := range mentionedUIDs(c.Content) {
+		// The author already gets a comment notice
+		if mentioned != owner {
+			addNotice(notice{UID: mentioned, Type: noticeMention, FromUID: uid, AwemeID: c.AwemeID, CommentID: c.CommentID, Content: c.Content})
+		}
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": commentView(c),
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bullet comment display modes, numbered as in Bilibili danmaku files.
+const (
+	danmakuModeScroll = 1
+	danmakuModeBottom = 4
+	danmakuModeTop    = 5
+
+	danmakuDefaultColor = 0xffffff
+	danmakuDefaultSize  = 25
+	danmakuMaxLength    = 100
+)
+
+type danmaku struct {
+	ID         string  `json:"id"`
+	AwemeID    string  `json:"aweme_id"`
+	UID        string  `json:"uid,omitempty"`
+	Time       float64 `json:"time"`
+	Text       string  `json:"text"`
+	Mode       int     `json:"mode"`
+	Color      int     `json:"color"`
+	Size       int     `json:"size"`
+	CreateTime int64   `json:"create_time"`
+	Source     string  `json:"source,omitempty"`
+}
+
+// insertDanmaku adds items to a video keeping the list ordered by playback
+// time. It must be called with commentsMu held.
+func insertDanmaku(awemeID string, items ...*danmaku) {
+	vc := videoCommentsFor(awemeID, true)
+	vc.Danmaku = append(vc.Danmaku, items...)
+	sort.SliceStable(vc.Danmaku, func(i, j int) bool {
+		return vc.Danmaku[i].Time < vc.Danmaku[j].Time
+	})
+}
+
+func newDanmakuID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// videoDanmakuHandler returns the bullet comments of ?id= between ?from= and
+// ?to= seconds, ordered by time. Missing bounds mean the whole video.
+func videoDanmakuHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	from, to := 0.0, -1.0
+	if f, err := strconv.ParseFloat(r.URL.Query().Get("from"), 64); err == nil {
+		from = f
+	}
+	if t, err := strconv.ParseFloat(r.URL.Query().Get("to"), 64); err == nil {
+		to = t
+	}
+
+	list := make([]*danmaku, 0)
+	commentsMu.Lock()
+	if vc := videoCommentsFor(id, false); vc != nil {
+		start := sort.Search(len(vc.Danmaku), func(i int) bool {
+			return vc.Danmaku[i].Time >= from
+		})
+		for _, d := range vc.Danmaku[start:] {
+			if to >= 0 && d.Time >= to {
+				break
+			}
+			list = append(list, d)
+		}
+	}
+	commentsMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"total": len(list),
+			"list":  list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// videoDanmakuAddHandler posts a bullet comment and broadcasts it to everyone
+// watching the video.
+func videoDanmakuAddHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		AwemeID string  `json:"aweme_id"`
+		Time    float64 `json:"time"`
+		Text    string  `json:"text"`
+		Mode    int     `json:"mode"`
+		Color   *int    `json:"color"`
+		Size    int     `json:"size"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len([]rune(req.Text)) > danmakuMaxLength || req.Time < 0 {
+		http.Error(w, "Invalid danmaku", http.StatusBadRequest)
+		return
+	}
+	if findVideo(req.AwemeID) == nil {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Video not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	d := &danmaku{
+		ID:         newDanmakuID(),
+		AwemeID:    req.AwemeID,
+		UID:        uid,
+		Time:       req.Time,
+		Text:       req.Text,
+		Mode:       req.Mode,
+		Color:      danmakuDefaultColor,
+		Size:       req.Size,
+		CreateTime: time.Now().Unix(),
+	}
+	if d.Mode != danmakuModeBottom && d.Mode != danmakuModeTop {
+		d.Mode = danmakuModeScroll
+	}
+	if req.Color != nil {
+		d.Color = *req.Color & 0xffffff
+	}
+	if d.Size <= 0 {
+		d.Size = danmakuDefaultSize
+	}
+
+	commentsMu.Lock()
+	insertDanmaku(d.AwemeID, d)
+	saveCommentState()
+	commentsMu.Unlock()
+
+	events.publish("danmaku:"+d.AwemeID, "danmaku", d)
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": d,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// videoDanmakuStreamHandler pushes "danmaku" events for new bullet comments
+// on ?id= over SSE.
+func videoDanmakuStreamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+	serveSSE(w, r, "danmaku:"+id, nil)
+}
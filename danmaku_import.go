@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Importers for danmaku archived alongside videos: Bilibili XML
+// (<d p="time,mode,size,color,...">text</d>) and ASS files produced by
+// danmaku converters such as danmaku2ass.
+
+// danmakuSidecars lists the files next to a video that may hold its danmaku.
+// A plain danmaku.xml only counts when the video is alone in its folder.
+func danmakuSidecars(videoPath string) []string {
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	paths := []string{
+		filepath.Join(dir, base+".xml"),
+		filepath.Join(dir, base+".danmaku.xml"),
+		filepath.Join(dir, base+".ass"),
+		filepath.Join(dir, base+".danmaku.ass"),
+	}
+	if onlyVideoInDir(videoPath) {
+		paths = append(paths, filepath.Join(dir, "danmaku.xml"))
+	}
+	return paths
+}
+
+// importDanmakuSidecars imports the danmaku files found next to a video.
+// Files are only parsed again when their mtime changes, so this is cheap to
+// call on every scan.
+func importDanmakuSidecars(videoPath, awemeID string) {
+	for _, path := range danmakuSidecars(videoPath) {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		source := filepath.Base(path)
+		commentsMu.Lock()
+		vc := videoCommentsFor(awemeID, false)
+		upToDate := vc != nil && vc.Imported[source] == info.ModTime().Unix()
+		commentsMu.Unlock()
+		if upToDate {
+			continue
+		}
+
+		n, err := importDanmakuFile(awemeID, path, strings.HasSuffix(path, ".danmaku.ass"))
+		if err != nil {
+			// Plain <name>.xml/.ass files are often something else; remember
+			// them so they are not parsed again on every scan.
+			commentsMu.Lock()
+			markDanmakuImported(awemeID, source, info.ModTime().Unix())
+			saveCommentState()
+			commentsMu.Unlock()
+			continue
+		}
+		log.Printf("Imported %d danmaku for %s from %s", n, awemeID, path)
+	}
+}
+
+// markDanmakuImported must be called with commentsMu held.
+func markDanmakuImported(awemeID, source string, mtime int64) {
+	vc := videoCommentsFor(awemeID, true)
+	if vc.Imported == nil {
+		vc.Imported = make(map[string]int64)
+	}
+	vc.Imported[source] = mtime
+}
+
+// importDanmakuFile replaces the danmaku previously imported from the same
+// file name with the contents of path. ASS files that do not look like
+// danmaku are rejected unless force is set.
+func importDanmakuFile(awemeID, path string, force bool) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var items []*danmaku
+	if strings.EqualFold(filepath.Ext(path), ".ass") {
+		items, err = parseASSDanmaku(f, force)
+	} else {
+		items, err = parseBilibiliXML(f)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	source := filepath.Base(path)
+	now := time.Now().Unix()
+	for _, d := range items {
+		d.ID = newDanmakuID()
+		d.AwemeID = awemeID
+		d.Source = source
+		d.CreateTime = now
+	}
+
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	vc := videoCommentsFor(awemeID, true)
+	kept := vc.Danmaku[:0]
+	for _, d := range vc.Danmaku {
+		if d.Source != source {
+			kept = append(kept, d)
+		}
+	}
+	vc.Danmaku = kept
+	insertDanmaku(awemeID, items...)
+	markDanmakuImported(awemeID, source, info.ModTime().Unix())
+	saveCommentState()
+	return len(items), nil
+}
+
+// bilibiliModes maps Bilibili danmaku modes onto the supported ones. Reverse
+// scrolling becomes normal scrolling; advanced (7) and code (8) danmaku are
+// dropped.
+var bilibiliModes = map[int]int{
+	1: danmakuModeScroll,
+	2: danmakuModeScroll,
+	3: danmakuModeScroll,
+	4: danmakuModeBottom,
+	5: danmakuModeTop,
+	6: danmakuModeScroll,
+}
+
+func parseBilibiliXML(r io.Reader) ([]*danmaku, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	var items []*danmaku
+	sawRoot := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == "i" {
+			sawRoot = true
+			continue
+		}
+		if start.Name.Local != "d" {
+			continue
+		}
+		var d struct {
+			P    string `xml:"p,attr"`
+			Text string `xml:",chardata"`
+		}
+		if err := decoder.DecodeElement(&d, &start); err != nil {
+			return nil, err
+		}
+		fields := strings.Split(d.P, ",")
+		if len(fields) < 4 {
+			continue
+		}
+		t, err1 := strconv.ParseFloat(fields[0], 64)
+		mode, err2 := strconv.Atoi(fields[1])
+		size, err3 := strconv.Atoi(fields[2])
+		color, err4 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		mode, ok = bilibiliModes[mode]
+		text := strings.TrimSpace(d.Text)
+		if !ok || text == "" {
+			continue
+		}
+		items = append(items, &danmaku{
+			Time:  t,
+			Text:  text,
+			Mode:  mode,
+			Color: color & 0xffffff,
+			Size:  size,
+		})
+	}
+	if !sawRoot {
+		return nil, errors.New("not a Bilibili danmaku file")
+	}
+	return items, nil
+}
+
+var (
+	assOverride = regexp.MustCompile(`\{[^}]*\}`)
+	assColor    = regexp.MustCompile(`\\1?c&H([0-9A-Fa-f]{1,6})&`)
+	assFontSize = regexp.MustCompile(`\\fs(\d+)`)
+	assAlign    = regexp.MustCompile(`\\an(\d)`)
+)
+
+// parseASSDanmaku reads the Dialogue events of an ASS file. Events moved
+// with \move scroll, \an8 events sit at the top and \an2 events at the
+// bottom. Unless force is set, the file must scroll most of its events to be
+// accepted as danmaku rather than ordinary subtitles.
+func parseASSDanmaku(r io.Reader, force bool) ([]*danmaku, error) {
+	// Default [Events] column order, replaced by the file's Format line
+	columns := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	inEvents := false
+	moving := 0
+
+	var items []*danmaku
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\xef\xbb\xbf"))
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "format":
+			columns = columns[:0]
+			for _, c := range strings.Split(value, ",") {
+				columns = append(columns, strings.ToLower(strings.TrimSpace(c)))
+			}
+		case "dialogue":
+			fields := strings.SplitN(value, ",", len(columns))
+			if len(fields) < len(columns) {
+				continue
+			}
+			row := make(map[string]string, len(columns))
+			for i, c := range columns {
+				row[c] = fields[i]
+			}
+			start, err := parseASSTime(row["start"])
+			if err != nil {
+				continue
+			}
+			raw := row["text"]
+			text := strings.TrimSpace(strings.ReplaceAll(assOverride.ReplaceAllString(raw, ""), `\N`, " "))
+			if text == "" {
+				continue
+			}
+			d := &danmaku{
+				Time:  start,
+				Text:  text,
+				Mode:  danmakuModeScroll,
+				Color: danmakuDefaultColor,
+				Size:  danmakuDefaultSize,
+			}
+			if strings.Contains(raw, `\move(`) {
+				moving++
+			} else if m := assAlign.FindStringSubmatch(raw); m != nil {
+				switch m[1] {
+				case "7", "8", "9":
+					d.Mode = danmakuModeTop
+				case "1", "2", "3":
+					d.Mode = danmakuModeBottom
+				}
+			}
+			if m := assColor.FindStringSubmatch(raw); m != nil {
+				// ASS colours are &HBBGGRR&
+				bgr, _ := strconv.ParseInt(m[1], 16, 32)
+				d.Color = int(bgr&0xff)<<16 | int(bgr&0xff00) | int(bgr>>16&0xff)
+			}
+			if m := assFontSize.FindStringSubmatch(raw); m != nil {
+				d.Size, _ = strconv.Atoi(m[1])
+			}
+			items = append(items, d)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !force && moving*2 < len(items) {
+		return nil, errors.New("ASS file does not look like danmaku")
+	}
+	return items, nil
+}
+
+// parseASSTime parses H:MM:SS.cc into seconds.
+func parseASSTime(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid ASS time %q", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("invalid ASS time %q", s)
+	}
+	return float64(h*3600+m*60) + sec, nil
+}
+
+// runImportDanmaku implements the import-danmaku subcommand:
+//
+//	douyin import-danmaku [--media dir] [--state dir] <video> <danmaku.xml|.ass>...
+func runImportDanmaku(args []string) {
+	fset := flag.NewFlagSet("import-danmaku", flag.ExitOnError)
+	fset.StringVar(&mediaDir, "media", "media", "Path to media directory")
+	fset.StringVar(&stateDir, "state", "state", "Path to directory for persisted server state")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: douyin import-danmaku [--media dir] [--state dir] <video> <danmaku.xml|.ass>...")
+		fmt.Fprintln(fset.Output(), "Stop the server first: it keeps the state in memory and would overwrite the import.")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if err := checkStateUnlocked(); err != nil {
+		log.Fatal(err)
+	}
+
+	videoPath := fset.Arg(0)
+	absMedia, err1 := filepath.Abs(mediaDir)
+	absVideo, err2 := filepath.Abs(videoPath)
+	if err1 != nil || err2 != nil {
+		log.Fatalf("Failed to resolve paths")
+	}
+	relPath, err := filepath.Rel(absMedia, absVideo)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		log.Fatalf("%s is not inside the media directory %s", videoPath, mediaDir)
+	}
+	awemeID := mediaID(relPath)
+
+	loadCommentState()
+	for _, path := range fset.Args()[1:] {
+		// Files named explicitly are always treated as danmaku
+		n, err := importDanmakuFile(awemeID, path, true)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", path, err)
+		}
+		fmt.Printf("Imported %d danmaku from %s\n", n, path)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Importer for the personal data archive that Douyin and TikTok let users
+// download. Archives are either JSON (user_data.json) or a tree of TXT files
+// such as "Activity/Video Browsing History.txt", with entries made of a date
+// and a video link. Entries are sorted into history, likes and favourites by
+// the section or file they appear in.
+
+const (
+	exportHistory  = "history"
+	exportLikes    = "likes"
+	exportFavorite = "favorites"
+)
+
+type exportEntry struct {
+	kind    string
+	videoID string
+	time    int64
+}
+
+var (
+	// Video ids in share links: /video/<id>, ?modal_id=<id>, ?item_id=<id>
+	exportLinkID = regexp.MustCompile(`(?:/video/|[?&](?:modal_id|item_id|aweme_id)=)(\d{8,20})`)
+	exportDate   = regexp.MustCompile(`\d{4}[-/]\d{2}[-/]\d{2}[ T]\d{2}:\d{2}:\d{2}`)
+	// Long digit runs in local file names, e.g. "title [7123456789012345678].mp4"
+	fileVideoID = regexp.MustCompile(`\d{15,20}`)
+)
+
+// exportKind classifies a JSON key path or TXT file name. Likes are checked
+// first since TikTok stores them as "Like List" / "ItemFavoriteList".
+func exportKind(path string) string {
+	path = strings.ToLower(path)
+	switch {
+	case strings.Contains(path, "comment") || strings.Contains(path, "评论"):
+		return ""
+	case strings.Contains(path, "like") || strings.Contains(path, "点赞") || strings.Contains(path, "喜欢"):
+		return exportLikes
+	case strings.Contains(path, "favorite") || strings.Contains(path, "favourite") || strings.Contains(path, "collect") || strings.Contains(path, "收藏"):
+		return exportFavorite
+	case strings.Contains(path, "history") || strings.Contains(path, "browsing") || strings.Contains(path, "watch") || strings.Contains(path, "观看") || strings.Contains(path, "浏览"):
+		return exportHistory
+	}
+	return ""
+}
+
+// parseExportTime accepts the date formats used by both exports, falling
+// back to zero when nothing matches.
+func parseExportTime(s string) int64 {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > 1e12 {
+			return n / 1000
+		}
+		return n
+	}
+	if m := exportDate.FindString(s); m != "" {
+		m = strings.ReplaceAll(strings.Replace(m, "T", " ", 1), "/", "-")
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", m, time.Local); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+// exportVideoID finds the video id of an entry from its link or id fields.
+func exportVideoID(fields map[string]interface{}) string {
+	for key, v := range fields {
+		s, ok := v.(string)
+		if !ok {
+			if n, isNum := v.(float64); isNum {
+				s = strconv.FormatFloat(n, 'f', 0, 64)
+			} else {
+				continue
+			}
+		}
+		switch strings.ToLower(key) {
+		case "aweme_id", "awemeid", "video_id", "videoid", "item_id", "itemid":
+			return s
+		}
+		if m := exportLinkID.FindStringSubmatch(s); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func exportEntryTime(fields map[string]interface{}) int64 {
+	for key, v := range fields {
+		k := strings.ToLower(key)
+		if k != "date" && k != "time" && k != "create_time" && k != "timestamp" && !strings.Contains(k, "时间") && !strings.Contains(k, "日期") {
+			continue
+		}
+		switch t := v.(type) {
+		case string:
+			return parseExportTime(t)
+		case float64:
+			return parseExportTime(strconv.FormatFloat(t, 'f', 0, 64))
+		}
+	}
+	return 0
+}
+
+// parseExportJSON walks a JSON export and collects the entries of every list
+// whose key path names a known section.
+func parseExportJSON(data []byte) ([]exportEntry, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var entries []exportEntry
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for key, child := range t {
+				walk(path+"/"+key, child)
+			}
+		case []interface{}:
+			kind := exportKind(path)
+			for _, item := range t {
+				fields, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if kind != "" {
+					if id := exportVideoID(fields); id != "" {
+						entries = append(entries, exportEntry{kind: kind, videoID: id, time: exportEntryTime(fields)})
+						continue
+					}
+				}
+				walk(path, fields)
+			}
+		}
+	}
+	walk("", root)
+	return entries, nil
+}
+
+// parseExportTXT reads "Date: ...\nLink: ..." blocks. Each link takes the
+// most recent date seen before it.
+func parseExportTXT(kind string, r io.Reader) ([]exportEntry, error) {
+	var entries []exportEntry
+	var last int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t := parseExportTime(line); t > 0 {
+			last = t
+		}
+		if m := exportLinkID.FindStringSubmatch(line); m != nil {
+			entries = append(entries, exportEntry{kind: kind, videoID: m[1], time: last})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// readExportArchive parses every JSON and TXT file of an archive, which may
+// be a zip file or an extracted directory.
+func readExportArchive(path string) ([]exportEntry, error) {
+	var entries []exportEntry
+	parse := func(name string, r io.Reader) error {
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext != ".json" && ext != ".txt" {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		var found []exportEntry
+		if ext == ".json" {
+			found, err = parseExportJSON(data)
+		} else if kind := exportKind(name); kind != "" {
+			found, err = parseExportTXT(kind, bytes.NewReader(data))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		entries = append(entries, found...)
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			rel, _ := filepath.Rel(path, p)
+			return parse(rel, f)
+		})
+		return entries, err
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = parse(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// localVideoIDs maps platform video ids to the aweme_id of local files, using
+// the id in a yt-dlp .info.json or a long number in the file name.
+func localVideoIDs() map[string]string {
+	scanMediaVideos()
+	ids := make(map[string]string)
+	mediaPathsMu.Lock()
+	paths := make(map[string]string, len(mediaPaths))
+	for awemeID, path := range mediaPaths {
+		paths[awemeID] = path
+	}
+	mediaPathsMu.Unlock()
+
+	for awemeID, path := range paths {
+		for _, id := range fileVideoID.FindAllString(filepath.Base(path), -1) {
+			ids[id] = awemeID
+		}
+		if info := loadInfoJSON(path); info != nil && info.ID != "" {
+			ids[info.ID] = awemeID
+		}
+	}
+	return ids
+}
+
+// runImportExport implements the import-export subcommand:
+//
+//	douyin import-export [--media dir] [--state dir] [--private dir] [--formats file] [--uid uid] <archive.zip|dir>
+func runImportExport(args []string) {
+	var uid string
+	fset := flag.NewFlagSet("import-export", flag.ExitOnError)
+	fset.StringVar(&mediaDir, "media", "media", "Path to media directory")
+	fset.StringVar(&stateDir, "state", "state", "Path to directory for persisted server state")
+	fset.StringVar(&uid, "uid", localUID, "User the imported records belong to")
+	scanFlags(fset)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: douyin import-export [--media dir] [--state dir] [--private dir] [--formats file] [--uid uid] <archive.zip|dir>")
+		fmt.Fprintln(fset.Output(), "Stop the server first: it keeps the state in memory and would overwrite the import.")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	if err := checkStateUnlocked(); err != nil {
+		log.Fatal(err)
+	}
+
+	entries, err := readExportArchive(fset.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", fset.Arg(0), err)
+	}
+
+	// Scan like the server, without queueing background rewrites
+	loadFormats()
+	faststartMode = faststartOff
+
+	// Scanning imports danmaku sidecars, so the comment state must be loaded
+	// to avoid overwriting it.
+	loadCommentState()
+	loadSocialState()
+	loadLibraryState()
+	ids := localVideoIDs()
+
+	total := make(map[string]int)
+	matched := make(map[string]int)
+	added := make(map[string]int)
+
+	socialMu.Lock()
+	libraryMu.Lock()
+	liked := make(map[string]bool)
+	for _, l := range social.Likes {
+		if l.UID == uid {
+			liked[l.AwemeID] = true
+		}
+	}
+	favorite := make(map[string]bool)
+	for _, f := range library.Favorites {
+		if f.UID == uid {
+			favorite[f.AwemeID] = true
+		}
+	}
+	watched := make(map[historyRecord]bool)
+	for _, h := range library.History {
+		watched[h] = true
+	}
+
+	for _, e := range entries {
+		total[e.kind]++
+		awemeID, ok := ids[e.videoID]
+		if !ok {
+			continue
+		}
+		matched[e.kind]++
+		switch e.kind {
+		case exportHistory:
+			h := historyRecord{UID: uid, AwemeID: awemeID, CreateTime: e.time}
+			if !watched[h] {
+				watched[h] = true
+				library.History = append(library.History, h)
+				added[e.kind]++
+			}
+		case exportLikes:
+			if !liked[awemeID] {
+				liked[awemeID] = true
+				social.Likes = append(social.Likes, likeRecord{UID: uid, AwemeID: awemeID, CreateTime: e.time})
+				added[e.kind]++
+			}
+		case exportFavorite:
+			if !favorite[awemeID] {
+				favorite[awemeID] = true
+				library.Favorites = append(library.Favorites, favoriteRecord{UID: uid, AwemeID: awemeID, CreateTime: e.time})
+				added[e.kind]++
+			}
+		}
+	}
+	saveSocialState()
+	saveLibraryState()
+	libraryMu.Unlock()
+	socialMu.Unlock()
+
+	for _, kind := range []string{exportHistory, exportLikes, exportFavorite} {
+		fmt.Printf("%s: %d entries, %d matched local videos, %d added\n", kind, total[kind], matched[kind], added[kind])
+	}
+}
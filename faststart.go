@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Faststart: MP4 files with their moov box after mdat (common for screen
+// recordings) cannot start playing before the whole file is downloaded. The
+// scanner records such files in the catalog and a background worker rewrites
+// them with moov in front, patching the chunk offsets in stco/co64. The copy
+// goes to cacheDir/faststart and /media/ serves it instead of the original;
+// with --faststart inplace the original file is replaced.
+
+// Faststart modes.
+const (
+	faststartOff     = "off"
+	faststartCache   = "cache"
+	faststartInPlace = "inplace"
+)
+
+var faststartMode string
+
+var faststartQueue = newFileQueue()
+
+// startFaststart starts the rewriting worker unless it is turned off. Unknown
+// modes fall back to cache, so a typo never rewrites the originals.
+func startFaststart() {
+	switch faststartMode {
+	case faststartOff, faststartCache, faststartInPlace:
+	default:
+		log.Printf("Unknown faststart mode %q, using %s", faststartMode, faststartCache)
+		faststartMode = faststartCache
+	}
+	if faststartMode == faststartOff {
+		return
+	}
+	faststartQueue.start("Faststart", faststartFile)
+}
+
+// faststartPath is where the rewritten copy of an MP4 goes.
+func faststartPath(awemeID, src string) (string, error) {
+	version, err := fileVersion(src)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "faststart", awemeID+"-"+version+filepath.Ext(src)), nil
+}
+
+// applyFaststart records whether moov comes after the media data and queues
+// such files for rewriting.
+func applyFaststart(id, src string) {
+	probe := probeMedia(src)
+	if probe == nil || probe.Container != "mp4" {
+		return
+	}
+	recordProbe(id, probe)
+
+	if !probe.MoovAtEnd || faststartMode == faststartOff {
+		return
+	}
+	if faststartMode == faststartCache {
+		if dest, err := faststartPath(id, src); err != nil {
+			return
+		} else if _, err := os.Stat(dest); err == nil {
+			return
+		}
+	}
+	faststartQueue.add(src)
+}
+
+// faststartFile rewrites one file according to faststartMode.
+func faststartFile(src string) error {
+	dest := src
+	if faststartMode != faststartInPlace {
+		rel, err := filepath.Rel(mediaDir, src)
+		if err != nil {
+			return err
+		}
+		if dest, err = faststartPath(mediaID(rel), src); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.faststart", dest, os.Getpid())
+	defer os.Remove(tmp)
+	if err := writeFaststart(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	log.Printf("Moved moov to the front of %s", src)
+	return nil
+}
+
+// writeFaststart copies the MP4 at src to dst with moov right after ftyp.
+func writeFaststart(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	top, err := readMP4Boxes(f, 0, stat.Size())
+	if err != nil {
+		return err
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return errNoMoov
+	}
+	if _, ok := findMP4Box(top, "moof"); ok {
+		return errors.New("fragmented files are not supported")
+	}
+	if moov.size > maxSampleTable {
+		return fmt.Errorf("mp4: box %q is too large", moov.typ)
+	}
+
+	// moov goes after ftyp; everything between there and the old moov moves
+	// down by the size of the new moov.
+	var insert int64
+	if len(top) > 0 && top[0].typ == "ftyp" {
+		insert = top[0].end()
+	}
+	if insert >= moov.offset {
+		return errors.New("moov is already at the front")
+	}
+
+	// The new moov has the same size whatever the shift, so build it once
+	// to measure it. Offsets switch to 64 bits if the shifted ones may no
+	// longer fit 32 bits.
+	wide := stat.Size()+2*moov.size > math.MaxUint32
+	newMoov, err := faststartMoov(f, moov, 0, insert, wide)
+	if err != nil {
+		return err
+	}
+	newMoov, err = faststartMoov(f, moov, int64(len(newMoov)), insert, wide)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, insert))
+	if err == nil {
+		_, err = out.Write(newMoov)
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, insert, moov.offset-insert))
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, moov.end(), stat.Size()-moov.end()))
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// faststartMoov rebuilds moov with every chunk offset in [insert, moov)
+// moved by shift bytes, the size of the new moov. Chunks after the old moov
+// move by the difference between the new and old moov sizes. With wide,
+// stco boxes are converted to co64.
+func faststartMoov(f *os.File, b mp4Box, shift, insert int64, wide bool) ([]byte, error) {
+	move := func(off uint64) uint64 {
+		switch {
+		case int64(off) >= insert && int64(off) < b.offset:
+			return uint64(int64(off) + shift)
+		case int64(off) >= b.end():
+			return uint64(int64(off) + shift - b.size)
+		}
+		return off
+	}
+	var rebuild func(b mp4Box) ([]byte, error)
+	rebuild = func(b mp4Box) ([]byte, error) {
+		switch b.typ {
+		case "moov", "trak", "mdia", "minf", "stbl":
+			children, err := mp4Children(f, b)
+			if err != nil {
+				return nil, err
+			}
+			var parts [][]byte
+			for _, c := range children {
+				part, err := rebuild(c)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, part)
+			}
+			return mp4BoxBytes(b.typ, parts...), nil
+		case "stco", "co64":
+			data, err := readMP4BoxData(f, b, maxSampleTable)
+			if err != nil {
+				return nil, err
+			}
+			entrySize := 4
+			if b.typ == "co64" {
+				entrySize = 8
+			}
+			count, entries, err := mp4Entries(data, 0, entrySize)
+			if err != nil {
+				return nil, err
+			}
+			typ, outSize := b.typ, entrySize
+			if wide {
+				typ, outSize = "co64", 8
+			}
+			out := binary.BigEndian.AppendUint32(nil, uint32(count))
+			for i := 0; i < count; i++ {
+				var off uint64
+				if entrySize == 8 {
+					off = binary.BigEndian.Uint64(entries[i*8:])
+				} else {
+					off = uint64(binary.BigEndian.Uint32(entries[i*4:]))
+				}
+				off = move(off)
+				if outSize == 8 {
+					out = binary.BigEndian.AppendUint64(out, off)
+				} else {
+					out = binary.BigEndian.AppendUint32(out, uint32(off))
+				}
+			}
+			return mp4FullBoxBytes(typ, 0, 0, out), nil
+		}
+		return rawMP4Box(f, b)
+	}
+	return rebuild(b)
+}
+
+// faststartMedia serves the rewritten copy of an MP4 in place of the
+// original when there is one.
+func faststartMedia(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if faststartMode == faststartCache {
+			rel := path.Clean("/" + r.URL.Path)[1:]
+			src := filepath.Join(mediaDir, filepath.FromSlash(rel))
+			if dest, err := faststartPath(mediaID(rel), src); err == nil {
+				if _, err := os.Stat(dest); err == nil {
+					http.ServeFile(w, r, dest)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The video file types the scanner and uploads accept. The defaults below can
+// be changed with a JSON file (--formats) listing entries that add new formats
+// or change the fields they list of the default with the same extension:
+//
+//	[{"ext": ".flv", "mime": "video/x-flv"}, {"ext": ".ogg", "disabled": true}]
+//
+// Formats browsers do not play (native false) can be remuxed to fragmented
+// MP4 on the fly through ffmpeg (--remux), without converting the library.
+
+type mediaFormat struct {
+	Ext  string `json:"ext"`
+	MIME string `json:"mime"`
+	// Container selects the header parser: mp4, webm or ogg. Others are
+	// listed without duration or size.
+	Container string `json:"container,omitempty"`
+	// Native is set for formats browsers play in <video>.
+	Native bool `json:"native"`
+	// Upload allows the format for uploads.
+	Upload bool `json:"upload"`
+	// NoFtyp accepts uploads of mp4 containers that do not start with an
+	// ftyp box, as older QuickTime files do.
+	NoFtyp   bool `json:"no_ftyp,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+var mediaFormats = []*mediaFormat{
+	{Ext: ".mp4", MIME: "video/mp4", Container: "mp4", Native: true, Upload: true},
+	{Ext: ".m4v", MIME: "video/x-m4v", Container: "mp4", Native: true, Upload: true},
+	{Ext: ".mov", MIME: "video/quicktime", Container: "mp4", Native: true, Upload: true, NoFtyp: true},
+	{Ext: ".webm", MIME: "video/webm", Container: "webm", Native: true, Upload: true},
+	{Ext: ".ogg", MIME: "video/ogg", Container: "ogg", Native: true, Upload: true},
+	{Ext: ".mkv", MIME: "video/x-matroska", Container: "webm"},
+	{Ext: ".avi", MIME: "video/x-msvideo"},
+	{Ext: ".ts", MIME: "video/mp2t"},
+}
+
+var formatsPath string
+
+// remuxPath is the ffmpeg used by /remux/, empty when remuxing is off.
+var remuxPath string
+
+func loadFormats() {
+	data, err := os.ReadFile(formatsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read formats: %v", err)
+		}
+	} else {
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Printf("Failed to parse formats: %v", err)
+			list = nil
+		}
+		for _, raw := range list {
+			var entry struct {
+				Ext string `json:"ext"`
+			}
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				log.Printf("Failed to parse format %s: %v", raw, err)
+				continue
+			}
+			ext := strings.ToLower(entry.Ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			// Entries for a known extension only change the fields they list
+			f := mediaFormatFor(ext)
+			if f == nil {
+				f = &mediaFormat{}
+				mediaFormats = append(mediaFormats, f)
+			}
+			if err := json.Unmarshal(raw, f); err != nil {
+				log.Printf("Failed to parse format %s: %v", raw, err)
+			}
+			f.Ext = ext
+		}
+		log.Printf("Loaded %d formats from %s", len(list), formatsPath)
+	}
+
+	// Served with the right Content-Type by /media/; Go's own table maps
+	// .ts to TypeScript on some systems
+	for _, f := range mediaFormats {
+		if f.MIME != "" && !f.Disabled {
+			mime.AddExtensionType(f.Ext, f.MIME)
+		}
+	}
+
+	if remuxPath != "" {
+		if _, err := exec.LookPath(remuxPath); err != nil {
+			log.Printf("Remuxing disabled: %v", err)
+			remuxPath = ""
+		}
+	}
+}
+
+// mediaFormatFor returns the format of a file name, or nil when it is not a
+// video.
+func mediaFormatFor(name string) *mediaFormat {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, f := range mediaFormats {
+		if f.Ext == ext {
+			return f
+		}
+	}
+	return nil
+}
+
+// isVideoFile reports whether the scanner picks up a file.
+func isVideoFile(name string) bool {
+	f := mediaFormatFor(name)
+	return f != nil && !f.Disabled
+}
+
+// uploadFormats lists the extensions accepted for upload.
+func uploadFormats() []string {
+	var exts []string
+	for _, f := range mediaFormats {
+		if f.Upload && !f.Disabled {
+			exts = append(exts, f.Ext)
+		}
+	}
+	return exts
+}
+
+func remuxURL(awemeID string) string {
+	return "/remux/" + awemeID + ".mp4"
+}
+
+// applyRemux points play_addr of videos in formats browsers cannot play at
+// the remux endpoint, keeping the original file as a fallback.
+func applyRemux(video map[string]interface{}, awemeID, path string) {
+	f := mediaFormatFor(path)
+	if f == nil || f.Native || remuxPath == "" {
+		return
+	}
+	v, ok := video["video"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if playAddr, ok := v["play_addr"].(map[string]interface{}); ok {
+		urls, _ := playAddr["url_list"].([]string)
+		playAddr["url_list"] = append([]string{remuxURL(awemeID)}, urls...)
+	}
+}
+
+// remuxHandler streams a video as fragmented MP4, copying the video stream
+// and converting the audio to AAC. ?start= seeks to a time in seconds, since
+// the stream itself cannot be seeked.
+func remuxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	awemeID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/remux/"), ".mp4")
+	if remuxPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	path, ok := localMediaPath(r, awemeID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	args := []string{"-hide_banner", "-nostdin", "-loglevel", "error"}
+	if start, err := strconv.ParseFloat(r.URL.Query().Get("start"), 64); err == nil && start > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start))
+	}
+	args = append(args,
+		"-i", path,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "copy", "-c:a", "aac",
+		"-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"pipe:1",
+	)
+	// Killed when the client goes away
+	cmd := exec.CommandContext(r.Context(), remuxPath, args...)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		log.Printf("Remux of %s failed: %v %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+}
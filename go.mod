@@ -1,3 +1,5 @@
 module douyin
 
 go 1.24.0
+
+require golang.org/x/crypto v0.48.0
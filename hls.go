@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HLS packaging of local MP4 files in pure Go. The file's sample tables are
+// cut into fMP4 segments of about hlsTargetDuration seconds, each starting at
+// a keyframe (stss) of the video track:
+//
+//	/hls/<aweme_id>/index.m3u8   VOD playlist
+//	/hls/<aweme_id>/init.mp4     initialization segment (moov + mvex)
+//	/hls/<aweme_id>/<n>.m4s      media segment (moof + mdat)
+//
+// Segments are written to cacheDir/hls the first time they are requested.
+
+const hlsTargetDuration = 6.0
+
+// cacheDir holds files derived from media (HLS segments, ...). They can be
+// deleted at any time and are rebuilt on demand.
+var cacheDir string
+
+type hlsSegment struct {
+	duration float64
+	// first and last (exclusive) sample of each track
+	from, to []int
+}
+
+type hlsPlan struct {
+	tracks   []*mp4Track
+	segments []hlsSegment
+}
+
+var hlsPlanCache sidecarCache
+
+// loadHLSPlan parses the tracks of an MP4 and decides where segments start.
+func loadHLSPlan(path string) (*hlsPlan, error) {
+	plan, _ := hlsPlanCache.load(path, func(path string) (interface{}, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		_, tracks, err := readMP4Tracks(f, stat.Size())
+		if err != nil {
+			return nil, err
+		}
+		return planHLSSegments(tracks)
+	}).(*hlsPlan)
+	if plan == nil {
+		return nil, errors.New("hls: file cannot be segmented")
+	}
+	return plan, nil
+}
+
+func planHLSSegments(all []*mp4Track) (*hlsPlan, error) {
+	plan := &hlsPlan{}
+	var primary *mp4Track
+	for _, t := range all {
+		if (t.handler != "vide" && t.handler != "soun") || len(t.samples) == 0 || t.timescale == 0 {
+			continue
+		}
+		plan.tracks = append(plan.tracks, t)
+		if primary == nil || primary.handler != "vide" && t.handler == "vide" {
+			primary = t
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("hls: no audio or video samples")
+	}
+
+	// Segment boundaries in seconds, at keyframes of the primary track
+	seconds := func(t *mp4Track, i int) float64 {
+		return float64(t.samples[i].dts) / float64(t.timescale)
+	}
+	bounds := []float64{0}
+	for i, s := range primary.samples {
+		if s.sync && i > 0 && seconds(primary, i)-bounds[len(bounds)-1] >= hlsTargetDuration {
+			bounds = append(bounds, seconds(primary, i))
+		}
+	}
+	last := primary.samples[len(primary.samples)-1]
+	end := float64(last.dts+uint64(last.duration)) / float64(primary.timescale)
+	bounds = append(bounds, math.Inf(1))
+
+	next := make([]int, len(plan.tracks))
+	for b := 1; b < len(bounds); b++ {
+		seg := hlsSegment{from: make([]int, len(plan.tracks)), to: make([]int, len(plan.tracks))}
+		for k, t := range plan.tracks {
+			seg.from[k] = next[k]
+			for next[k] < len(t.samples) && seconds(t, next[k]) < bounds[b] {
+				next[k]++
+			}
+			seg.to[k] = next[k]
+		}
+		if b == len(bounds)-1 {
+			seg.duration = end - bounds[b-1]
+		} else {
+			seg.duration = bounds[b] - bounds[b-1]
+		}
+		plan.segments = append(plan.segments, seg)
+	}
+	return plan, nil
+}
+
+// hlsPlaylist renders the VOD playlist of a plan. query is appended to the
+// segment URLs, so a ?token= given for a private video reaches them too.
+func hlsPlaylist(plan *hlsPlan, query string) []byte {
+	target := 1.0
+	for _, s := range plan.segments {
+		target = math.Max(target, math.Ceil(s.duration))
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if query != "" {
+		query = "?" + query
+	}
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4%s\"\n", query)
+	for i, s := range plan.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.m4s%s\n", s.duration, i, query)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(b.String())
+}
+
+func mp4BoxBytes(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], typ)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func mp4FullBoxBytes(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4BoxBytes(typ, append([][]byte{head}, payload...)...)
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// rawMP4Box returns a box from the file, header included.
+func rawMP4Box(f *os.File, b mp4Box) ([]byte, error) {
+	if b.size > maxSampleTable {
+		return nil, fmt.Errorf("mp4: box %q is too large", b.typ)
+	}
+	data := make([]byte, b.size)
+	_, err := f.ReadAt(data, b.offset)
+	return data, err
+}
+
+// fragmentedTrak copies a trak box, replacing its sample tables with empty
+// ones as fragmented files require.
+func fragmentedTrak(f *os.File, b mp4Box) ([]byte, error) {
+	if b.typ == "stbl" {
+		stsd, ok := mp4Path(f, b, "stsd")
+		if !ok {
+			return nil, errors.New("mp4: no stsd box")
+		}
+		raw, err := rawMP4Box(f, stsd)
+		if err != nil {
+			return nil, err
+		}
+		return mp4BoxBytes("stbl",
+			raw,
+			mp4FullBoxBytes("stts", 0, 0, be32(0)),
+			mp4FullBoxBytes("stsc", 0, 0, be32(0)),
+			mp4FullBoxBytes("stsz", 0, 0, be32(0), be32(0)),
+			mp4FullBoxBytes("stco", 0, 0, be32(0)),
+		), nil
+	}
+	if b.typ != "trak" && b.typ != "mdia" && b.typ != "minf" {
+		return rawMP4Box(f, b)
+	}
+	children, err := mp4Children(f, b)
+	if err != nil {
+		return nil, err
+	}
+	var parts [][]byte
+	for _, c := range children {
+		part, err := fragmentedTrak(f, c)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return mp4BoxBytes(b.typ, parts...), nil
+}
+
+// hlsInitSegment builds ftyp + moov with the tracks of the plan and an mvex
+// box announcing the fragments.
+func hlsInitSegment(f *os.File, plan *hlsPlan) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	top, err := readMP4Boxes(f, 0, stat.Size())
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return nil, errNoMoov
+	}
+	mvhd, ok := mp4Path(f, moov, "mvhd")
+	if !ok {
+		return nil, errors.New("mp4: no mvhd box")
+	}
+	rawMvhd, err := rawMP4Box(f, mvhd)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := [][]byte{rawMvhd}
+	var trex [][]byte
+	for _, t := range plan.tracks {
+		trak, err := fragmentedTrak(f, t.trak)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, trak)
+		trex = append(trex, mp4FullBoxBytes("trex", 0, 0, be32(t.id), be32(1), be32(0), be32(0), be32(0)))
+	}
+	parts = append(parts, mp4BoxBytes("mvex", trex...))
+
+	ftyp := mp4BoxBytes("ftyp", []byte("iso6"), be32(0), []byte("iso6isommp41"))
+	return append(ftyp, mp4BoxBytes("moov", parts...)...), nil
+}
+
+// Sample flags of fragment samples: keyframes depend on nothing, other
+// samples depend on earlier ones and are not sync samples.
+const (
+	fragmentSyncFlags    = 0x02000000
+	fragmentNonSyncFlags = 0x01010000
+)
+
+// hlsMediaSegment builds moof + mdat for segment n.
+func hlsMediaSegment(f *os.File, plan *hlsPlan, n int) ([]byte, error) {
+	seg := plan.segments[n]
+
+	build := func(dataOffsets []uint32) ([]byte, []uint32) {
+		parts := [][]byte{mp4FullBoxBytes("mfhd", 0, 0, be32(uint32(n+1)))}
+		var sizes []uint32
+		var offset uint32
+		for k, t := range plan.tracks {
+			samples := t.samples[seg.from[k]:seg.to[k]]
+			if len(samples) == 0 {
+				continue
+			}
+			trun := be32(uint32(len(samples)))
+			if dataOffsets != nil {
+				trun = binary.BigEndian.AppendUint32(trun, dataOffsets[len(sizes)])
+			} else {
+				trun = binary.BigEndian.AppendUint32(trun, 0)
+			}
+			var size uint32
+			for _, s := range samples {
+				flags := uint32(fragmentNonSyncFlags)
+				if s.sync {
+					flags = fragmentSyncFlags
+				}
+				trun = binary.BigEndian.AppendUint32(trun, s.duration)
+				trun = binary.BigEndian.AppendUint32(trun, s.size)
+				trun = binary.BigEndian.AppendUint32(trun, flags)
+				trun = binary.BigEndian.AppendUint32(trun, uint32(s.cto))
+				size += s.size
+			}
+			sizes = append(sizes, offset)
+			offset += size
+			tfdt := binary.BigEndian.AppendUint64(nil, samples[0].dts)
+			parts = append(parts, mp4BoxBytes("traf",
+				// default-base-is-moof
+				mp4FullBoxBytes("tfhd", 0, 0x020000, be32(t.id)),
+				mp4FullBoxBytes("tfdt", 1, 0, tfdt),
+				// data offset, duration, size, flags and composition offset
+				mp4FullBoxBytes("trun", 1, 0x000f01, trun),
+			))
+		}
+		return mp4BoxBytes("moof", parts...), sizes
+	}
+
+	// The data offsets depend on the size of moof, which does not depend on
+	// their values: build once to measure, then again with the offsets.
+	moof, starts := build(nil)
+	offsets := make([]uint32, len(starts))
+	for i, s := range starts {
+		offsets[i] = uint32(len(moof)) + 8 + s
+	}
+	moof, _ = build(offsets)
+
+	var payload []byte
+	for k, t := range plan.tracks {
+		for _, s := range t.samples[seg.from[k]:seg.to[k]] {
+			buf := make([]byte, s.size)
+			if _, err := f.ReadAt(buf, s.offset); err != nil {
+				return nil, err
+			}
+			payload = append(payload, buf...)
+		}
+	}
+	return append(moof, mp4BoxBytes("mdat", payload)...), nil
+}
+
+// hlsCacheDir returns the cache folder of a file. Its name changes with the
+// file's size and mtime, so edited files get fresh segments.
+func hlsCacheDir(awemeID, path string) (string, error) {
+	version, err := fileVersion(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "hls", awemeID+"-"+version), nil
+}
+
+// cachedFile returns path, building and writing it first when missing.
+func cachedFile(path string, build func() ([]byte, error)) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	data, err := build()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Concurrent requests for the same segment each write their own file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hlsURL returns the playlist URL of a local video.
+func hlsURL(awemeID string) string {
+	return "/hls/" + awemeID + "/index.m3u8"
+}
+
+// applyHLS advertises the HLS playlist of MP4 files next to play_addr.
+func applyHLS(video map[string]interface{}, awemeID, path string) {
+	probe := probeMedia(path)
+	if probe == nil || probe.Container != "mp4" {
+		return
+	}
+	if v, ok := video["video"].(map[string]interface{}); ok {
+		v["play_addr_hls"] = map[string]interface{}{
+			"uri":      awemeID,
+			"url_list": []string{hlsURL(awemeID)},
+		}
+	}
+}
+
+// localMediaPath resolves an aweme_id for a request, applying the same
+// access rules as /media/ to private files.
+func localMediaPath(r *http.Request, awemeID string) (string, bool) {
+	path, ok := mediaPathByID(awemeID)
+	if !ok {
+		// Private videos are not part of the public scan
+		if a := requestUser(r); a != nil {
+			privateVideos(a.UID)
+			path, ok = knownMediaPath(awemeID)
+		}
+	}
+	if !ok {
+		return "", false
+	}
+	if rel, err := filepath.Rel(mediaDir, path); err == nil {
+		if owner, private := privateOwner(filepath.ToSlash(rel)); private {
+			if a := requestUser(r); a == nil || a.UID != owner {
+				return "", false
+			}
+		}
+	}
+	return path, true
+}
+
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	awemeID, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	path, ok := localMediaPath(r, awemeID)
+	if !ok || probeMedia(path) == nil || probeMedia(path).Container != "mp4" {
+		http.NotFound(w, r)
+		return
+	}
+	plan, err := loadHLSPlan(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	dir, err := hlsCacheDir(awemeID, path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var build func(f *os.File) ([]byte, error)
+	switch {
+	case name == "index.m3u8":
+		// Cheap to render, and it depends on the request's token
+		var query string
+		if token := r.URL.Query().Get("token"); token != "" {
+			query = "token=" + url.QueryEscape(token)
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(hlsPlaylist(plan, query))
+		return
+	case name == "init.mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		build = func(f *os.File) ([]byte, error) { return hlsInitSegment(f, plan) }
+	case strings.HasSuffix(name, ".m4s"):
+		n, err := strconv.Atoi(strings.TrimSuffix(name, ".m4s"))
+		if err != nil || n < 0 || n >= len(plan.segments) || strconv.Itoa(n)+".m4s" != name {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		build = func(f *os.File) ([]byte, error) { return hlsMediaSegment(f, plan, n) }
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	cached := filepath.Join(dir, name)
+	err = cachedFile(cached, func() ([]byte, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return build(f)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, cached)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// Watch history and favourites of each user, persisted as
+// state/library.json. Likes live in the social state.
+
+type historyRecord struct {
+	UID        string `json:"uid"`
+	AwemeID    string `json:"aweme_id"`
+	CreateTime int64  `json:"create_time"`
+}
+
+type favoriteRecord struct {
+	UID        string `json:"uid"`
+	AwemeID    string `json:"aweme_id"`
+	CreateTime int64  `json:"create_time"`
+}
+
+type libraryState struct {
+	History   []historyRecord  `json:"history"`
+	Favorites []favoriteRecord `json:"favorites"`
+}
+
+var library libraryState
+var libraryMu sync.Mutex
+
+func loadLibraryState() {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	if err := loadState("library", &library); err != nil {
+		log.Printf("Failed to load library: %v", err)
+	}
+}
+
+// saveLibraryState must be called with libraryMu held.
+func saveLibraryState() {
+	if err := saveState("library", &library); err != nil {
+		log.Printf("Failed to save library: %v", err)
+	}
+}
+
+// timedID is an aweme_id with the time it was recorded.
+type timedID struct {
+	awemeID string
+	time    int64
+}
+
+// recordedVideos resolves ids to videos, most recent first. A video recorded
+// several times is listed once, and ids missing from the catalog are skipped.
+func recordedVideos(ids []timedID) []map[string]interface{} {
+	sort.SliceStable(ids, func(i, j int) bool {
+		return ids[i].time > ids[j].time
+	})
+	index := videoIndex()
+	seen := make(map[string]bool)
+	list := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if seen[id.awemeID] {
+			continue
+		}
+		seen[id.awemeID] = true
+		if v, ok := index[id.awemeID]; ok {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func historyVideos(uid string) []map[string]interface{} {
+	var ids []timedID
+	libraryMu.Lock()
+	for _, h := range library.History {
+		if h.UID == uid {
+			ids = append(ids, timedID{h.AwemeID, h.CreateTime})
+		}
+	}
+	libraryMu.Unlock()
+	return recordedVideos(ids)
+}
+
+func favoriteVideos(uid string) []map[string]interface{} {
+	var ids []timedID
+	libraryMu.Lock()
+	for _, f := range library.Favorites {
+		if f.UID == uid {
+			ids = append(ids, timedID{f.AwemeID, f.CreateTime})
+		}
+	}
+	libraryMu.Unlock()
+	return recordedVideos(ids)
+}
+
+func likedVideos(uid string) []map[string]interface{} {
+	var ids []timedID
+	socialMu.Lock()
+	for _, l := range social.Likes {
+		if l.UID == uid {
+			ids = append(ids, timedID{l.AwemeID, l.CreateTime})
+		}
+	}
+	socialMu.Unlock()
+	return recordedVideos(ids)
+}
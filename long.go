@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Long videos: local files longer than --long-duration seconds, or stored in
+// a "long" folder, make up /video/long/recommended. With --long-exclude they
+// are left out of the short-video feed.
+
+const longVideoDir = "long"
+
+var (
+	longDuration int
+	longExclude  bool
+)
+
+// isLongVideo reports whether a local video belongs to the long section.
+func isLongVideo(video map[string]interface{}) bool {
+	id, _ := video["aweme_id"].(string)
+	path, ok := knownMediaPath(id)
+	if !ok {
+		return false
+	}
+	if rel, err := filepath.Rel(mediaDir, path); err == nil {
+		for _, dir := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+			if strings.EqualFold(dir, longVideoDir) {
+				return true
+			}
+		}
+	}
+	return longDuration > 0 && videoDurationMs(video) > longDuration*1000
+}
+
+// splitLongVideos separates the long videos from the short ones.
+func splitLongVideos(videos []map[string]interface{}) (short, long []map[string]interface{}) {
+	for _, v := range videos {
+		if isLongVideo(v) {
+			long = append(long, v)
+		} else {
+			short = append(short, v)
+		}
+	}
+	return short, long
+}
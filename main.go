@@ -16,6 +16,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type spaHandler struct {
@@ -95,6 +96,12 @@ type ResponseData struct {
 	List  interface{} `json:"list"`
 }
 
+// decodeJSONBody decodes the JSON body of a POST request into v.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+}
+
 
 // Global variable to hold loaded JSON data
 var mediaDir string
@@ -217,23 +224,42 @@ func loadMusicData() {
 }
 
 func scanMediaVideos() ([]map[string]interface{}, error) {
+	return scanVideoTree(mediaDir)
+}
+
+// scanVideoTree lists the videos and albums under root, which is mediaDir or
+// one of its subdirectories. The private folder is only scanned when it is
+// asked for explicitly.
+func scanVideoTree(root string) ([]map[string]interface{}, error) {
 	videos := make([]map[string]interface{}, 0)
 
-	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			// If mediaDir itself doesn't exist, we'll catch it.
-			if os.IsNotExist(err) && path == mediaDir {
+			// If root itself doesn't exist, we'll catch it.
+			if os.IsNotExist(err) && path == root {
 				return nil // Treat as empty
 			}
 			return err
 		}
 		if d.IsDir() {
+			if path != root && isPrivateRoot(path) {
+				return fs.SkipDir
+			}
+			if path != root && isAlbumDir(path) {
+				if album := scanAlbum(path); album != nil {
+					videos = append(videos, album)
+				}
+				return fs.SkipDir
+			}
 			return nil
 		}
 
 		fileName := d.Name()
-		lowerName := strings.ToLower(fileName)
-		if !strings.HasSuffix(lowerName, ".mp4") && !strings.HasSuffix(lowerName, ".webm") && !strings.HasSuffix(lowerName, ".ogg") {
+		if !isVideoFile(fileName) {
+			return nil
+		}
+		// Broken files are reported by /admin/media/problems instead
+		if mediaProblem(path) != "" {
 			return nil
 		}
 
@@ -247,106 +273,46 @@ func scanMediaVideos() ([]map[string]interface{}, error) {
 		desc := strings.TrimSuffix(fileName, filepath.Ext(fileName))
 
 		// Generate a fake ID
-		hash := md5.Sum([]byte(relPath))
-		id := hex.EncodeToString(hash[:])
+		id := mediaID(relPath)
 
-		parts := strings.Split(relPath, string(os.PathSeparator))
-		for i, part := range parts {
-			parts[i] = url.PathEscape(part)
-		}
-		videoUrl := fmt.Sprintf("/media/%s", strings.Join(parts, "/"))
+		videoUrl := mediaURL(relPath)
 		// Use a placeholder for cover
 		coverUrl := "" // Could be a default image
 
-		video := map[string]interface{}{
-			"type":        "recommend-video",
-			"aweme_id":    id,
-			"desc":        desc,
-			"create_time": 1691665927,
-			"music": map[string]interface{}{
-				"id":     123456789,
-				"title":  "Original Sound",
-				"author": "Local Artist",
-				"cover_medium": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"cover_thumb": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"cover_large": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"play_url": map[string]interface{}{
-					"uri":     "music_uri",
-					"url_list": []string{""},
-				},
-			},
-			"video": map[string]interface{}{
-				"play_addr": map[string]interface{}{
-					"uri":     id,
-					"url_list": []string{videoUrl},
-					"width":   720,
-					"height":  1280,
-				},
-				"cover": map[string]interface{}{
-					"url_list": []string{coverUrl},
-				},
-				"width":  720,
-				"height": 1280,
-			},
-			"author": map[string]interface{}{
-				"uid":       "local_user",
-				"nickname":  "Local User",
-				"unique_id": "local_user_id",
-				"avatar_thumb": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"avatar_medium": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"avatar_large": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"avatar_168x168": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"avatar_larger": map[string]interface{}{
-					"url_list": []string{""},
-				},
-				"cover_url": []map[string]interface{}{
-					{
-						"url_list": []string{""},
-					},
-				},
-				"share_info": map[string]interface{}{
-					"share_qrcode_url": map[string]interface{}{
-						"url_list": []string{""},
-					},
-					"share_url": "",
-					"share_image_url": map[string]interface{}{
-						"url_list": []string{""},
-					},
-				},
-			},
-			"statistics": map[string]interface{}{
-				"digg_count":    0,
-				"comment_count": 0,
-				"share_count":   0,
-				"play_count":    0,
-			},
-			"share_info": map[string]interface{}{
-				"share_url": "",
-			},
-			"status": map[string]interface{}{
-				"is_delete": false,
-			},
-			"aweme_control": map[string]interface{}{
-				"can_forward":      true,
-				"can_share":        true,
-				"can_comment":      true,
-				"can_show_comment": true,
-			},
-		}
+		video := newLocalVideo(id, desc, videoUrl, coverUrl)
+		rememberMediaPath(id, path)
+
+		// Duration and size from the container headers
+		applyProbe(video, path)
+		// Shooting date and place, else the file's mtime
+		applyCapture(video, path)
+		applyCodecs(video, id, path)
+		applyFaststart(id, path)
+		// HLS playlist next to play_addr for MP4 files
+		applyHLS(video, id, path)
+		// Remuxed stream for containers browsers cannot play
+		applyRemux(video, id, path)
+		// H.264 renditions made by the transcoding queue
+		applyRenditions(video, id, path)
+		// Seek preview thumbnails for long videos
+		applyStoryboard(video, id, path)
+		// and a short animated preview for grids
+		applyPreview(video, id, path)
+
+		// Owner and upload metadata
+		applyCatalogRecord(video, id, path)
+
+		// Fill in metadata downloaded alongside the video by yt-dlp
+		applyInfoJSON(video, path)
+		// and by Kodi/Jellyfin
+		applyNFO(video, path)
+
+		// Chapters from the file or a chapters.txt
+		applyChapters(video, path)
+
+		// Pick up danmaku files stored next to the video
+		importDanmakuSidecars(path, id)
+
 		videos = append(videos, video)
 		return nil
 	})
@@ -358,13 +324,217 @@ func scanMediaVideos() ([]map[string]interface{}, error) {
 		return nil, err
 	}
 
+	applyInteractionCounts(videos)
 	return videos, nil
 }
 
+// findVideo looks an aweme up by id among the local and the mock videos.
+func findVideo(id string) map[string]interface{} {
+	if videos, err := scanMediaVideos(); err == nil {
+		for _, v := range videos {
+			if v["aweme_id"] == id {
+				return v
+			}
+		}
+	}
+	for _, v := range jsonVideos {
+		if idString(v["aweme_id"]) == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// videoIndex maps aweme ids to the local and the mock videos, for handlers
+// that resolve many ids at once.
+func videoIndex() map[string]map[string]interface{} {
+	index := make(map[string]map[string]interface{})
+	for _, v := range jsonVideos {
+		index[idString(v["aweme_id"])] = v
+	}
+	if videos, err := scanMediaVideos(); err == nil {
+		for _, v := range videos {
+			index[idString(v["aweme_id"])] = v
+		}
+	}
+	return index
+}
+
+// idString formats an id decoded from JSON, which may be a string or a number.
+func idString(v interface{}) string {
+	if n, ok := v.(float64); ok {
+		return fmt.Sprintf("%.0f", n)
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// mediaPaths maps the aweme_id of every scanned file to its path on disk.
+var mediaPaths = make(map[string]string)
+var mediaPathsMu sync.Mutex
+
+func rememberMediaPath(id, path string) {
+	mediaPathsMu.Lock()
+	mediaPaths[id] = path
+	mediaPathsMu.Unlock()
+}
+
+// knownMediaPath returns the file behind a local aweme_id seen by a
+// previous scan.
+func knownMediaPath(id string) (string, bool) {
+	mediaPathsMu.Lock()
+	defer mediaPathsMu.Unlock()
+	path, ok := mediaPaths[id]
+	return path, ok
+}
+
+// mediaPathByID returns the file behind a local aweme_id, rescanning the
+// media directory once if the id has not been seen yet.
+func mediaPathByID(id string) (string, bool) {
+	if path, ok := knownMediaPath(id); ok {
+		return path, true
+	}
+	scanMediaVideos()
+	return knownMediaPath(id)
+}
+
+// mediaID derives the stable aweme_id of a file from its path in mediaDir.
+// The path is hashed with forward slashes, so every caller gets the same id
+// whichever separator it passes.
+func mediaID(relPath string) string {
+	hash := md5.Sum([]byte(filepath.ToSlash(relPath)))
+	return hex.EncodeToString(hash[:])
+}
+
+// isMediaID reports whether id has the form of a local aweme_id, as opposed
+// to the numeric ids of the mock data.
+func isMediaID(id string) bool {
+	if len(id) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// mediaURL turns a path relative to mediaDir into an escaped /media/ URL.
+func mediaURL(relPath string) string {
+	return fileURL("/media/", relPath)
+}
+
+// fileURL escapes each segment of a relative file path and joins it to prefix.
+func fileURL(prefix, relPath string) string {
+	parts := strings.Split(relPath, string(os.PathSeparator))
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return prefix + strings.Join(parts, "/")
+}
+
+// newLocalVideo builds the aweme object used for every locally hosted item.
+func newLocalVideo(id, desc, videoUrl, coverUrl string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "recommend-video",
+		"aweme_id":    id,
+		"aweme_type":  0,
+		"desc":        desc,
+		"create_time": 1691665927,
+		"music": map[string]interface{}{
+			"id":     123456789,
+			"title":  "Original Sound",
+			"author": "Local Artist",
+			"cover_medium": map[string]interface{}{
+				"url_list": []string{""},
+			},
+			"cover_thumb": map[string]interface{}{
+				"url_list": []string{""},
+			},
+			"cover_large": map[string]interface{}{
+				"url_list": []string{""},
+			},
+			"play_url": map[string]interface{}{
+				"uri":     "music_uri",
+				"url_list": []string{""},
+			},
+		},
+		"video": map[string]interface{}{
+			"play_addr": map[string]interface{}{
+				"uri":     id,
+				"url_list": []string{videoUrl},
+				"width":   720,
+				"height":  1280,
+			},
+			"cover": map[string]interface{}{
+				"url_list": []string{coverUrl},
+			},
+			"width":  720,
+			"height": 1280,
+		},
+		"author": newLocalAuthor(localUID, "Local User", ""),
+		"statistics": map[string]interface{}{
+			"digg_count":    0,
+			"comment_count": 0,
+			"share_count":   0,
+			"play_count":    0,
+		},
+		"share_info": map[string]interface{}{
+			"share_url": "",
+		},
+		"status": map[string]interface{}{
+			"is_delete": false,
+		},
+		"aweme_control": map[string]interface{}{
+			"can_forward":      true,
+			"can_share":        true,
+			"can_comment":      true,
+			"can_show_comment": true,
+		},
+	}
+}
+
+// newLocalAuthor builds the author object attached to locally hosted items.
+func newLocalAuthor(uid, nickname, avatarUrl string) map[string]interface{} {
+	return map[string]interface{}{
+		"uid":       uid,
+		"nickname":  nickname,
+		"unique_id": uid + "_id",
+		"avatar_thumb": map[string]interface{}{
+			"url_list": []string{avatarUrl},
+		},
+		"avatar_medium": map[string]interface{}{
+			"url_list": []string{avatarUrl},
+		},
+		"avatar_large": map[string]interface{}{
+			"url_list": []string{avatarUrl},
+		},
+		"avatar_168x168": map[string]interface{}{
+			"url_list": []string{avatarUrl},
+		},
+		"avatar_larger": map[string]interface{}{
+			"url_list": []string{avatarUrl},
+		},
+		"cover_url": []map[string]interface{}{
+			{
+				"url_list": []string{""},
+			},
+		},
+		"share_info": map[string]interface{}{
+			"share_qrcode_url": map[string]interface{}{
+				"url_list": []string{""},
+			},
+			"share_url": "",
+			"share_image_url": map[string]interface{}{
+				"url_list": []string{""},
+			},
+		},
+	}
+}
+
 func recommendedHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Accept-Codecs")
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -390,6 +560,15 @@ func recommendedHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if longExclude {
+		videos, _ = splitLongVideos(videos)
+	}
+	// ?sort=newest|oldest by create_time, file order otherwise
+	if order := r.URL.Query().Get("sort"); order == sortNewest || order == sortOldest {
+		sortVideos(videos, order)
+	}
+	// Leave out what the client cannot play
+	videos = adaptForClient(videos, clientCodecs(r))
 	total = len(videos)
 	end := start + pageSize
 	if end > total {
@@ -452,7 +631,7 @@ func musicHandler(w http.ResponseWriter, r *http.Request) {
 func videoLongRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Accept-Codecs")
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -468,8 +647,16 @@ func videoLongRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(pageSizeStr, "%d", &pageSize)
 	}
 
+	// Local long videos replace the mock list when there are any
+	source := jsonVideos
+	if videos, err := scanMediaVideos(); err == nil {
+		if _, long := splitLongVideos(videos); len(long) > 0 {
+			source = adaptForClient(long, clientCodecs(r))
+		}
+	}
+
 	var list interface{}
-	total := len(jsonVideos)
+	total := len(source)
 	if total > 0 {
 		end := start + pageSize
 		if end > total {
@@ -478,7 +665,7 @@ func videoLongRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 		if start > total {
 			start = total
 		}
-		list = jsonVideos[start:end]
+		list = source[start:end]
 	} else {
 		list = []interface{}{}
 	}
@@ -511,9 +698,17 @@ func videoCommentsHandler(w http.ResponseWriter, r *http.Request) {
 		id = "7260749400622894336"
 	}
 
+	// Comments posted on this instance are listed first, then the ones
+	// downloaded by yt-dlp
+	local := localCommentsView(id)
+	local = append(local, infoJSONCommentsView(id)...)
+
 	// Try to read json file first
 	path := filepath.Join(staticDir, "data", "comments", fmt.Sprintf("video_id_%s.json", id))
 	data, err := os.ReadFile(path)
+	if err != nil && len(local) > 0 {
+		data, err = []byte("[]"), nil
+	}
 	if err != nil {
 		// Fallback to check if .md exists (simulating fetch logic which handles .md)
 		// Since we are server side, we can just look for .json.
@@ -534,6 +729,9 @@ func videoCommentsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to parse comments", http.StatusInternalServerError)
 		return
 	}
+	if mock, ok := comments.([]interface{}); ok && len(local) > 0 {
+		comments = append(local, mock...)
+	}
 
 	resp := map[string]interface{}{
 		"code": 200,
@@ -546,11 +744,35 @@ func videoCommentsHandler(w http.ResponseWriter, r *http.Request) {
 func videoPrivateHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	if r.Method == "OPTIONS" {
 		return
 	}
 
+	// With private folders configured, logged-in users see their own
+	// videos, even when they have none yet
+	if a := requestUser(r); a != nil && privateRoot() != "" {
+		private, err := privateVideos(a.UID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if private == nil {
+			private = []map[string]interface{}{}
+		}
+		finalResp := map[string]interface{}{
+			"code": 200,
+			"data": ResponseData{
+				Total: len(private),
+				List:  private,
+			},
+			"msg": "",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
 	// Logic from mock: allRecommendVideos.slice(100, 110)
 	var list interface{}
 	total := 10
@@ -581,24 +803,48 @@ func videoPrivateHandler(w http.ResponseWriter, r *http.Request) {
 func videoLikeHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	if r.Method == "OPTIONS" {
 		return
 	}
 
-	// Logic from mock: allRecommendVideos.slice(200, 350)
+	pageNo := 0
+	pageSize := 10
+	if p := r.URL.Query().Get("pageNo"); p != "" {
+		fmt.Sscanf(p, "%d", &pageNo)
+	}
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		fmt.Sscanf(ps, "%d", &pageSize)
+	}
+	offset := pageNo * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+
+	// Likes recorded on this instance replace the mock list; logged-in
+	// users get theirs even when it is empty
+	subset := likedVideos(requestUID(r))
+	if len(subset) == 0 && requestUser(r) == nil {
+		// Logic from mock: allRecommendVideos.slice(200, 350)
+		startIdx := 200
+		endIdx := 350
+		if len(jsonVideos) >= endIdx {
+			subset = jsonVideos[startIdx:endIdx]
+		} else if len(jsonVideos) > startIdx {
+			subset = jsonVideos[startIdx:]
+		}
+	}
+
+	total := len(subset)
 	var list interface{}
-	total := 150
-	startIdx := 200
-	endIdx := 350
-	if len(jsonVideos) >= endIdx {
-		list = jsonVideos[startIdx:endIdx]
-	} else if len(jsonVideos) > startIdx {
-		list = jsonVideos[startIdx:]
-		total = len(jsonVideos) - startIdx
-	} else {
+	end := offset + pageSize
+	if offset >= total {
 		list = []interface{}{}
-		total = 0
+	} else {
+		if end > total {
+			end = total
+		}
+		list = subset[offset:end]
 	}
 
 	resp := ResponseData{
@@ -615,30 +861,12 @@ func videoLikeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(finalResp)
 }
 
-func videoMyHandler(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	if r.Method == "OPTIONS" {
-		return
-	}
-
-	pageNo := 0
-	pageSize := 10
-	if p := r.URL.Query().Get("pageNo"); p != "" {
-		fmt.Sscanf(p, "%d", &pageNo)
-	}
-	if ps := r.URL.Query().Get("pageSize"); ps != "" {
-		fmt.Sscanf(ps, "%d", &pageSize)
-	}
-	offset := pageNo * pageSize
-
-	// Load specific user video list
-	// In mock it was hardcoded to user-12345xiaolaohu.md
+// mockUserVideos loads the video list of the mock profile. In the mock it
+// was hardcoded to user-12345xiaolaohu.md.
+func mockUserVideos() []map[string]interface{} {
 	path := filepath.Join(staticDir, "data", "user_video_list", "user-12345xiaolaohu.json")
 	data, err := os.ReadFile(path)
 	var userVideos []map[string]interface{}
-
 	if err == nil {
 		if err := json.Unmarshal(data, &userVideos); err != nil {
 			log.Printf("Failed to parse user videos: %v", err)
@@ -658,6 +886,40 @@ func videoMyHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	return userVideos
+}
+
+func videoMyHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	pageNo := 0
+	pageSize := 10
+	if p := r.URL.Query().Get("pageNo"); p != "" {
+		fmt.Sscanf(p, "%d", &pageNo)
+	}
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		fmt.Sscanf(ps, "%d", &pageSize)
+	}
+	offset := pageNo * pageSize
+
+	// Logged-in users get their own videos, sorted by
+	// ?sort=newest|views|pinned, even when they have none. In single-user
+	// mode the mock list stands in until there are local videos.
+	var userVideos []map[string]interface{}
+	if uid := requestUID(r); uid != "" {
+		owned := ownedVideos(uid, true)
+		sortVideos(owned, r.URL.Query().Get("sort"))
+		markPinned(owned)
+		userVideos = owned
+	}
+	if len(userVideos) == 0 && requestUser(r) == nil {
+		userVideos = mockUserVideos()
+	}
 
 	total := len(userVideos)
 	var list interface{}
@@ -687,7 +949,7 @@ func videoMyHandler(w http.ResponseWriter, r *http.Request) {
 func videoHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -701,6 +963,9 @@ func videoHistoryHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(ps, "%d", &pageSize)
 	}
 	offset := pageNo * pageSize
+	if offset < 0 {
+		offset = 0
+	}
 
 	// Mock logic: allRecommendVideos.slice(200, 350).slice(offset, limit)
 	var list interface{}
@@ -710,7 +975,12 @@ func videoHistoryHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get the subset first
 	var subset []map[string]interface{}
-	if len(jsonVideos) >= endIdx {
+	if history := historyVideos(requestUID(r)); len(history) > 0 || requestUser(r) != nil {
+		// Watch history recorded on this instance replaces the mock list;
+		// logged-in users get theirs even when it is empty
+		subset = history
+		total = len(history)
+	} else if len(jsonVideos) >= endIdx {
 		subset = jsonVideos[startIdx:endIdx]
 	} else if len(jsonVideos) > startIdx {
 		subset = jsonVideos[startIdx:]
@@ -775,7 +1045,7 @@ func userPanelHandler(w http.ResponseWriter, r *http.Request) {
 func userCollectHandler(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -785,7 +1055,12 @@ func userCollectHandler(w http.ResponseWriter, r *http.Request) {
 	videoTotal := 50
 	vStart := 350
 	vEnd := 400
-	if len(jsonVideos) >= vEnd {
+	if favorites := favoriteVideos(requestUID(r)); len(favorites) > 0 || requestUser(r) != nil {
+		// Favourites recorded on this instance replace the mock list;
+		// logged-in users get theirs even when it is empty
+		videoList = favorites
+		videoTotal = len(favorites)
+	} else if len(jsonVideos) >= vEnd {
 		videoList = jsonVideos[vStart:vEnd]
 	} else if len(jsonVideos) > vStart {
 		videoList = jsonVideos[vStart:]
@@ -822,6 +1097,22 @@ func userVideoListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id := r.URL.Query().Get("id")
+
+	// Public videos of local users, pinned first
+	if id != "" {
+		if owned := ownedVideos(id, false); len(owned) > 0 {
+			sortVideos(owned, r.URL.Query().Get("sort"))
+			markPinned(owned)
+			finalResp := map[string]interface{}{
+				"code": 200,
+				"data": owned,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(finalResp)
+			return
+		}
+	}
+
 	filePath := fmt.Sprintf("data/user_video_list/user-%s.json", id)
 	data, err := fs.ReadFile(fileSystem, filePath)
 	
@@ -906,7 +1197,9 @@ func postRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	offset := pageNo * pageSize
 	
-	total := len(jsonPosts)
+	// Local Markdown posts come first, then the mock posts unless replaced
+	posts := recommendedPosts()
+	total := len(posts)
 	var list interface{}
 	end := offset + pageSize
 	
@@ -918,7 +1211,7 @@ func postRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 		if end > total {
 			end = total
 		}
-		list = jsonPosts[offset:end]
+		list = posts[offset:end]
 	}
 
 	finalResp := map[string]interface{}{
@@ -952,7 +1245,8 @@ func shopRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	offset := pageNo * pageSize
 
-	total := len(jsonGoods)
+	goods := shopGoods()
+	total := len(goods)
 	var list interface{}
 	end := offset + pageSize
 	
@@ -962,7 +1256,7 @@ func shopRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 		if end > total {
 			end = total
 		}
-		list = jsonGoods[offset:end]
+		list = goods[offset:end]
 	}
 
 	finalResp := map[string]interface{}{
@@ -976,18 +1270,61 @@ func shopRecommendedHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(finalResp)
 }
 
+// scanFlags registers the flags that decide which files a media scan picks
+// up, so subcommands that scan see the same videos as the server.
+func scanFlags(fset *flag.FlagSet) {
+	fset.StringVar(&privateDir, "private", "private", "Folder inside the media directory holding private videos, one subfolder per user")
+	fset.StringVar(&formatsPath, "formats", "formats.json", "Path to a JSON file adding or changing the accepted video formats")
+}
+
 func main() {
+	// Subcommands run once and exit instead of starting the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-danmaku":
+			runImportDanmaku(os.Args[2:])
+			return
+		case "import-export":
+			runImportExport(os.Args[2:])
+			return
+		case "hash-password":
+			runHashPassword(os.Args[2:])
+			return
+		}
+	}
+
 	var staticPath string
 	var indexPath string
 	var mediaDirFlag string
+	var uploadMaxMB int64
 
 	flag.StringVar(&staticPath, "static", "dist", "Path to static files directory")
 	flag.StringVar(&indexPath, "index", "index.html", "Path to index.html")
 	flag.StringVar(&mediaDirFlag, "media", "media", "Path to media directory")
+	flag.StringVar(&postsDir, "posts", "posts", "Path to Markdown posts directory")
+	flag.StringVar(&postsMode, "posts-mode", "merge", "How local posts combine with mock posts: merge or replace")
+	flag.StringVar(&shopDir, "shop", "shop", "Path to local product catalog directory")
+	flag.IntVar(&longDuration, "long-duration", 60, "Local videos longer than this many seconds go to the long-video section; 0 disables")
+	flag.BoolVar(&longExclude, "long-exclude", false, "Leave long videos out of the short-video feed")
+	flag.Int64Var(&uploadMaxMB, "upload-max", 2048, "Maximum upload size in MB")
+	flag.IntVar(&pinMax, "pin-max", 3, "Maximum number of pinned videos per author")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "", "Path to ffmpeg for transcoding local videos into H.264 renditions; empty disables")
+	flag.IntVar(&transcodeWorkers, "transcode-workers", 1, "Number of videos transcoded at the same time")
+	flag.IntVar(&transcodeRetries, "transcode-retries", 2, "Times a failed transcode is retried")
+	flag.StringVar(&faststartMode, "faststart", "cache", "Moving moov to the front of MP4 files: off, cache (rewritten copy in the cache directory) or inplace")
+	flag.StringVar(&thumbnailerPath, "thumbnailer", "", "Path to ffmpeg for extracting preview frames; empty disables")
+	flag.IntVar(&storyboardInterval, "storyboard-interval", 10, "Seconds between the seek preview thumbnails of long videos")
+	flag.StringVar(&previewFormat, "preview-format", "mp4", "Format of animated previews: mp4 or webp")
+	scanFlags(flag.CommandLine)
+	flag.StringVar(&remuxPath, "remux", "", "Path to ffmpeg for streaming formats browsers cannot play as MP4; empty disables")
+	flag.StringVar(&cacheDir, "cache", "cache", "Path to directory for generated files such as HLS segments")
+	flag.StringVar(&stateDir, "state", "state", "Path to directory for persisted server state")
+	flag.StringVar(&accountsPath, "accounts", "accounts.json", "Path to accounts file; single-user mode if missing")
 	flag.Parse()
 
 	mediaDir = mediaDirFlag
 	staticDir = staticPath
+	uploadMaxSize = uploadMaxMB << 20
 
 	// Initialize fileSystem
 	if _, err := os.Stat(staticPath); err == nil {
@@ -1002,12 +1339,33 @@ func main() {
 		}
 	}
 
+	// Subcommands refuse to edit the state while this runs
+	lockStateDir()
+
 	// Load JSON data on startup
 	loadJsonData()
 	loadMusicData()
-
-	// Serve media files
-	http.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir(mediaDir))))
+	loadAccounts()
+	loadFormats()
+	loadShopState()
+	loadMessageState()
+	loadSocialState()
+	loadCommentState()
+	loadLibraryState()
+	loadCatalogState()
+	loadUploadState()
+	loadNoticeState()
+	loadTranscodeState()
+	startTranscoder()
+	startFaststart()
+	startStoryboards()
+	startPreviews()
+
+	// Serve media files; the private folder is checked against the session and
+	// MP4s rewritten for faststart are served from the cache
+	http.Handle("/media/", http.StripPrefix("/media/", privateMediaGuard(faststartMedia(http.FileServer(http.Dir(mediaDir))))))
+	// Serve images referenced by Markdown posts
+	http.Handle("/posts/", http.StripPrefix("/posts/", http.FileServer(http.Dir(postsDir))))
 
 	// API endpoints
 	http.HandleFunc("/video/recommended", recommendedHandler)
@@ -1017,18 +1375,53 @@ func main() {
 	http.HandleFunc("/video/like", videoLikeHandler)
 	http.HandleFunc("/video/my", videoMyHandler)
 	http.HandleFunc("/video/history", videoHistoryHandler)
+	http.HandleFunc("/video/digg", videoDiggHandler)
+	http.HandleFunc("/video/comment/add", videoCommentAddHandler)
+	http.HandleFunc("/video/danmaku", videoDanmakuHandler)
+	http.HandleFunc("/video/danmaku/add", videoDanmakuAddHandler)
+	http.HandleFunc("/video/danmaku/stream", videoDanmakuStreamHandler)
+	http.HandleFunc("/upload/", uploadHandler)
+	http.HandleFunc("/hls/", hlsHandler)
+	http.HandleFunc("/rendition/", renditionHandler)
+	http.HandleFunc("/remux/", remuxHandler)
+	http.HandleFunc("/storyboard/", storyboardHandler)
+	http.HandleFunc("/preview/", previewHandler)
+	http.HandleFunc("/transcode/jobs", transcodeJobsHandler)
+	http.HandleFunc("/transcode/retry", transcodeRetryHandler)
+	http.HandleFunc("/admin/media/problems", mediaProblemsHandler)
 	
 	http.HandleFunc("/user/panel", userPanelHandler)
 	http.HandleFunc("/user/collect", userCollectHandler)
 	http.HandleFunc("/user/video_list", userVideoListHandler)
 	http.HandleFunc("/user/friends", userFriendsHandler)
+	http.HandleFunc("/user/follow", userFollowHandler)
+	http.HandleFunc("/user/pin", userPinHandler)
+	http.HandleFunc("/user/login", userLoginHandler)
+	http.HandleFunc("/user/logout", userLogoutHandler)
 	
 	http.HandleFunc("/historyOther", historyOtherHandler)
 	http.HandleFunc("/post/recommended", postRecommendedHandler)
 	http.HandleFunc("/shop/recommended", shopRecommendedHandler)
+	http.HandleFunc("/shop/cart", shopCartHandler)
+	http.HandleFunc("/shop/cart/add", shopCartAddHandler)
+	http.HandleFunc("/shop/cart/remove", shopCartRemoveHandler)
+	http.HandleFunc("/shop/checkout", shopCheckoutHandler)
+	http.HandleFunc("/shop/orders", shopOrdersHandler)
+	http.HandleFunc("/shop/order/cancel", shopOrderCancelHandler)
+	http.Handle("/shop/assets/", http.StripPrefix("/shop/assets/", http.FileServer(http.Dir(shopDir))))
 	
 	http.HandleFunc("/music", musicHandler)
 
+	http.HandleFunc("/message/conversations", messageConversationsHandler)
+	http.HandleFunc("/message/history", messageHistoryHandler)
+	http.HandleFunc("/message/send", messageSendHandler)
+	http.HandleFunc("/message/ws", messageWSHandler)
+
+	http.HandleFunc("/notice/list", noticeListHandler)
+	http.HandleFunc("/notice/unread", noticeUnreadHandler)
+	http.HandleFunc("/notice/read", noticeReadHandler)
+	http.HandleFunc("/notice/stream", noticeStreamHandler)
+
 	// SPA handler for frontend
 	spa := spaHandler{fileSystem: fileSystem, indexPath: indexPath}
 	http.Handle("/", spa)
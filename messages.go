@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direct messages between the users of this instance. Messages are kept in
+// state/messages.json and pushed live to every open /message/ws connection of
+// both participants.
+
+const (
+	messageTypeText  = "text"
+	messageTypeVideo = "video"
+)
+
+type chatMessage struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	FromUID        string `json:"from_uid"`
+	ToUID          string `json:"to_uid"`
+	Type           string `json:"type"`
+	Content        string `json:"content"`
+	AwemeID        string `json:"aweme_id,omitempty"`
+	CreateTime     int64  `json:"create_time"`
+}
+
+// messageState is persisted as state/messages.json. ReadTime records, per uid
+// and conversation, the create_time of the last message the user has seen.
+type messageState struct {
+	Messages []*chatMessage              `json:"messages"`
+	ReadTime map[string]map[string]int64 `json:"read_time"`
+}
+
+var messages = messageState{ReadTime: make(map[string]map[string]int64)}
+var messagesMu sync.Mutex
+
+// chatConns holds the open WebSocket connections of each uid.
+var chatConns = make(map[string]map[*wsConn]bool)
+var chatConnsMu sync.Mutex
+
+func loadMessageState() {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	if err := loadState("messages", &messages); err != nil {
+		log.Printf("Failed to load messages: %v", err)
+	}
+	if messages.ReadTime == nil {
+		messages.ReadTime = make(map[string]map[string]int64)
+	}
+	// Older state files kept times in milliseconds
+	for _, m := range messages.Messages {
+		if m.CreateTime > 1e12 {
+			m.CreateTime /= 1000
+		}
+	}
+	for _, read := range messages.ReadTime {
+		for conv, t := range read {
+			if t > 1e12 {
+				read[conv] = t / 1000
+			}
+		}
+	}
+}
+
+// conversationID is the same for both participants.
+func conversationID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// markConversationRead must be called with messagesMu held.
+func markConversationRead(uid, convID string, t int64) {
+	read := messages.ReadTime[uid]
+	if read == nil {
+		read = make(map[string]int64)
+		messages.ReadTime[uid] = read
+	}
+	if t > read[convID] {
+		read[convID] = t
+	}
+}
+
+// messageView adds the shared video to video messages, looked up in videos
+// (a videoIndex built once per request).
+func messageView(m *chatMessage, videos map[string]map[string]interface{}) map[string]interface{} {
+	view := map[string]interface{}{
+		"id":              m.ID,
+		"conversation_id": m.ConversationID,
+		"from_uid":        m.FromUID,
+		"to_uid":          m.ToUID,
+		"type":            m.Type,
+		"content":         m.Content,
+		"create_time":     m.CreateTime,
+	}
+	if m.AwemeID != "" {
+		view["aweme_id"] = m.AwemeID
+		view["aweme"] = videos[m.AwemeID]
+	}
+	return view
+}
+
+type sendMessageRequest struct {
+	ToUID   string `json:"to_uid"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	AwemeID string `json:"aweme_id"`
+}
+
+// sendMessage validates, stores and delivers a message from uid, and returns
+// its view.
+func sendMessage(uid string, req sendMessageRequest) (map[string]interface{}, error) {
+	if !knownUser(req.ToUID) {
+		return nil, fmt.Errorf("user %s not found", req.ToUID)
+	}
+	if req.Type == "" {
+		req.Type = messageTypeText
+		if req.AwemeID != "" {
+			req.Type = messageTypeVideo
+		}
+	}
+	videos := make(map[string]map[string]interface{})
+	switch req.Type {
+	case messageTypeText:
+		if strings.TrimSpace(req.Content) == "" {
+			return nil, fmt.Errorf("empty message")
+		}
+	case messageTypeVideo:
+		video := findVideo(req.AwemeID)
+		if req.AwemeID == "" || video == nil {
+			return nil, fmt.Errorf("video %s not found", req.AwemeID)
+		}
+		videos[req.AwemeID] = video
+	default:
+		return nil, fmt.Errorf("unknown message type %s", req.Type)
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	m := &chatMessage{
+		ID:             hex.EncodeToString(buf),
+		ConversationID: conversationID(uid, req.ToUID),
+		FromUID:        uid,
+		ToUID:          req.ToUID,
+		Type:           req.Type,
+		Content:        req.Content,
+		AwemeID:        req.AwemeID,
+		CreateTime:     time.Now().Unix(),
+	}
+
+	messagesMu.Lock()
+	messages.Messages = append(messages.Messages, m)
+	markConversationRead(uid, m.ConversationID, m.CreateTime)
+	if err := saveState("messages", &messages); err != nil {
+		log.Printf("Failed to save messages: %v", err)
+	}
+	messagesMu.Unlock()
+
+	view := messageView(m, videos)
+	event := map[string]interface{}{
+		"event": "message",
+		"data":  view,
+	}
+	pushToUser(m.ToUID, event)
+	if m.ToUID != uid {
+		pushToUser(uid, event)
+	}
+	return view, nil
+}
+
+// pushToUser writes v to every open WebSocket of uid.
+func pushToUser(uid string, v interface{}) {
+	chatConnsMu.Lock()
+	conns := make([]*wsConn, 0, len(chatConns[uid]))
+	for c := range chatConns[uid] {
+		conns = append(conns, c)
+	}
+	chatConnsMu.Unlock()
+	for _, c := range conns {
+		if err := c.WriteJSON(v); err != nil {
+			c.Close()
+		}
+	}
+}
+
+func messageConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	type conversation struct {
+		id     string
+		peer   string
+		last   *chatMessage
+		unread int
+	}
+	byID := make(map[string]*conversation)
+
+	messagesMu.Lock()
+	read := messages.ReadTime[uid]
+	for _, m := range messages.Messages {
+		if m.FromUID != uid && m.ToUID != uid {
+			continue
+		}
+		c := byID[m.ConversationID]
+		if c == nil {
+			peer := m.ToUID
+			if peer == uid {
+				peer = m.FromUID
+			}
+			c = &conversation{id: m.ConversationID, peer: peer}
+			byID[m.ConversationID] = c
+		}
+		c.last = m
+		if m.FromUID != uid && m.CreateTime > read[m.ConversationID] {
+			c.unread++
+		}
+	}
+	messagesMu.Unlock()
+
+	convs := make([]*conversation, 0, len(byID))
+	for _, c := range byID {
+		convs = append(convs, c)
+	}
+	sort.Slice(convs, func(i, j int) bool {
+		return convs[i].last.CreateTime > convs[j].last.CreateTime
+	})
+
+	videos := videoIndex()
+	list := make([]map[string]interface{}, 0, len(convs))
+	for _, c := range convs {
+		list = append(list, map[string]interface{}{
+			"conversation_id": c.id,
+			"user":            accountAuthor(c.peer),
+			"last_message":    messageView(c.last, videos),
+			"unread_count":    c.unread,
+			"update_time":     c.last.CreateTime,
+		})
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"total": len(list),
+			"list":  list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// messageHistoryHandler returns the messages exchanged with ?uid=, oldest
+// first. Paging goes backwards in time with ?before=<message id>, the id of
+// the oldest message the client has; create_time is in seconds, too coarse
+// to page by.
+func messageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	peer := r.URL.Query().Get("uid")
+	pageSize := 20
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		fmt.Sscanf(ps, "%d", &pageSize)
+	}
+	before := r.URL.Query().Get("before")
+	convID := conversationID(uid, peer)
+
+	var history []*chatMessage
+	messagesMu.Lock()
+	for _, m := range messages.Messages {
+		if m.ConversationID != convID {
+			continue
+		}
+		if m.ID == before {
+			break
+		}
+		history = append(history, m)
+	}
+	total := len(history)
+	if len(history) > pageSize {
+		history = history[len(history)-pageSize:]
+	}
+	if before == "" && len(history) > 0 {
+		markConversationRead(uid, convID, history[len(history)-1].CreateTime)
+		if err := saveState("messages", &messages); err != nil {
+			log.Printf("Failed to save messages: %v", err)
+		}
+	}
+	messagesMu.Unlock()
+
+	videos := videoIndex()
+	list := make([]map[string]interface{}, 0, len(history))
+	for _, m := range history {
+		list = append(list, messageView(m, videos))
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"total":    total,
+			"has_more": total > len(list),
+			"list":     list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func messageSendHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req sendMessageRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var finalResp map[string]interface{}
+	if view, err := sendMessage(uid, req); err != nil {
+		finalResp = map[string]interface{}{
+			"code": 400,
+			"msg":  err.Error(),
+		}
+	} else {
+		finalResp = map[string]interface{}{
+			"code": 200,
+			"data": view,
+			"msg":  "",
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// messageWSHandler delivers new messages in real time. Clients may also send
+// messages over the socket using the /message/send body.
+func messageWSHandler(w http.ResponseWriter, r *http.Request) {
+	uid := requestUID(r)
+	if uid == "" {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	chatConnsMu.Lock()
+	if chatConns[uid] == nil {
+		chatConns[uid] = make(map[*wsConn]bool)
+	}
+	chatConns[uid][conn] = true
+	chatConnsMu.Unlock()
+
+	defer func() {
+		chatConnsMu.Lock()
+		delete(chatConns[uid], conn)
+		if len(chatConns[uid]) == 0 {
+			delete(chatConns, uid)
+		}
+		chatConnsMu.Unlock()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req sendMessageRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			conn.WriteJSON(map[string]interface{}{"event": "error", "msg": "Invalid message"})
+			continue
+		}
+		if _, err := sendMessage(uid, req); err != nil {
+			conn.WriteJSON(map[string]interface{}{"event": "error", "msg": err.Error()})
+		}
+	}
+}
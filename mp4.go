@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal ISO base media file (MP4/MOV) reader. Only box headers and the
+// few small boxes the probe needs are read, so large files are cheap to scan.
+
+type mp4Box struct {
+	typ    string
+	offset int64 // start of the box header
+	size   int64 // header included
+	header int64
+}
+
+func (b mp4Box) dataOffset() int64 { return b.offset + b.header }
+func (b mp4Box) dataSize() int64   { return b.size - b.header }
+func (b mp4Box) end() int64        { return b.offset + b.size }
+
+// readMP4Boxes lists the boxes between start and end.
+func readMP4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	buf := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(buf[:8], off); err != nil {
+			return boxes, err
+		}
+		b := mp4Box{
+			typ:    string(buf[4:8]),
+			offset: off,
+			size:   int64(binary.BigEndian.Uint32(buf[:4])),
+			header: 8,
+		}
+		switch b.size {
+		case 0:
+			// Box extends to the end of its parent
+			b.size = end - off
+		case 1:
+			if _, err := r.ReadAt(buf[8:16], off+8); err != nil {
+				return boxes, err
+			}
+			b.size = int64(binary.BigEndian.Uint64(buf[8:16]))
+			b.header = 16
+		}
+		if b.size < b.header || b.end() > end {
+			return boxes, fmt.Errorf("mp4: box %q at %d exceeds its parent", b.typ, off)
+		}
+		boxes = append(boxes, b)
+		off = b.end()
+	}
+	return boxes, nil
+}
+
+func mp4Children(r io.ReaderAt, parent mp4Box) ([]mp4Box, error) {
+	return readMP4Boxes(r, parent.dataOffset(), parent.end())
+}
+
+func findMP4Box(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// readMP4BoxData reads the payload of a box, refusing boxes over limit bytes.
+func readMP4BoxData(r io.ReaderAt, b mp4Box, limit int64) ([]byte, error) {
+	if b.dataSize() > limit {
+		return nil, fmt.Errorf("mp4: box %q is too large", b.typ)
+	}
+	data := make([]byte, b.dataSize())
+	_, err := r.ReadAt(data, b.dataOffset())
+	return data, err
+}
+
+// mp4Path follows a chain of box types from the children of parent.
+func mp4Path(r io.ReaderAt, parent mp4Box, path ...string) (mp4Box, bool) {
+	for _, typ := range path {
+		children, err := mp4Children(r, parent)
+		if err != nil && len(children) == 0 {
+			return mp4Box{}, false
+		}
+		next, ok := findMP4Box(children, typ)
+		if !ok {
+			return mp4Box{}, false
+		}
+		parent = next
+	}
+	return parent, true
+}
+
+var errNoMoov = errors.New("mp4: no moov box")
+
+// probeMP4 reads the duration, the display size of the first video track,
+// the codecs of the first video and audio tracks and, see readMP4Capture,
+// when and where the video was shot.
+func probeMP4(r io.ReaderAt, size int64) (*mediaProbe, error) {
+	top, err := readMP4Boxes(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return nil, errNoMoov
+	}
+	children, err := mp4Children(r, moov)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &mediaProbe{Container: "mp4"}
+	if mdat, ok := findMP4Box(top, "mdat"); ok && mdat.offset < moov.offset {
+		probe.MoovAtEnd = true
+	}
+	if mvhd, ok := findMP4Box(children, "mvhd"); ok {
+		data, err := readMP4BoxData(r, mvhd, 1024)
+		if err != nil {
+			return nil, err
+		}
+		probe.Duration = parseMvhdDuration(data)
+	}
+
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr, ok := mp4Path(r, trak, "mdia", "hdlr")
+		if !ok {
+			continue
+		}
+		data, err := readMP4BoxData(r, hdlr, 1024)
+		if err != nil || len(data) < 12 {
+			continue
+		}
+		switch string(data[8:12]) {
+		case "vide":
+			if probe.VideoCodec != "" {
+				continue
+			}
+			probe.VideoCodec = mp4SampleEntry(r, trak)
+			tkhd, ok := mp4Path(r, trak, "tkhd")
+			if !ok {
+				continue
+			}
+			data, err = readMP4BoxData(r, tkhd, 1024)
+			if err != nil {
+				continue
+			}
+			probe.Width, probe.Height = parseTkhdSize(data)
+		case "soun":
+			if probe.AudioCodec == "" {
+				probe.AudioCodec = mp4SampleEntry(r, trak)
+			}
+		}
+	}
+	readMP4Capture(r, moov, children, probe)
+	return probe, nil
+}
+
+// mp4SampleEntry returns the codec of a track: the type of the first entry
+// of its stsd box, such as avc1 or mp4a.
+func mp4SampleEntry(r io.ReaderAt, trak mp4Box) string {
+	stsd, ok := mp4Path(r, trak, "mdia", "minf", "stbl", "stsd")
+	if !ok {
+		return ""
+	}
+	// version/flags, entry count, then the first entry's size and type.
+	// Entries can be large, so only read up to there.
+	if stsd.dataSize() < 16 {
+		return ""
+	}
+	data := make([]byte, 16)
+	if _, err := r.ReadAt(data, stsd.dataOffset()); err != nil {
+		return ""
+	}
+	return codecFamily(string(data[12:16]))
+}
+
+// parseMvhdDuration returns the movie duration in seconds.
+func parseMvhdDuration(data []byte) float64 {
+	if len(data) < 4 {
+		return 0
+	}
+	var timescale uint32
+	var duration uint64
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(data[20:24])
+		duration = binary.BigEndian.Uint64(data[24:32])
+	} else {
+		if len(data) < 20 {
+			return 0
+		}
+		timescale = binary.BigEndian.Uint32(data[12:16])
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+	if timescale == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+// parseTkhdSize returns the display size of a track, swapped when the
+// transformation matrix rotates it by 90 or 270 degrees as phones do.
+func parseTkhdSize(data []byte) (int, int) {
+	// version/flags, times, track id, reserved, duration, then 52 bytes of
+	// reserved, layer, group, volume and matrix before width and height
+	off := 4 + 4 + 4 + 4 + 4 + 4
+	if len(data) > 0 && data[0] == 1 {
+		off = 4 + 8 + 8 + 4 + 4 + 8
+	}
+	matrix := off + 8 + 2 + 2 + 2 + 2
+	off = matrix + 36
+	if len(data) < off+8 {
+		return 0, 0
+	}
+	width := int(binary.BigEndian.Uint32(data[off:off+4]) >> 16)
+	height := int(binary.BigEndian.Uint32(data[off+4:off+8]) >> 16)
+
+	a := int32(binary.BigEndian.Uint32(data[matrix : matrix+4]))
+	b := int32(binary.BigEndian.Uint32(data[matrix+4 : matrix+8]))
+	if a == 0 && b != 0 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// mp4Sample is one access unit of a track. Times are in the track's
+// timescale.
+type mp4Sample struct {
+	offset   int64
+	size     uint32
+	dts      uint64
+	duration uint32
+	cto      int32 // composition time offset
+	sync     bool
+}
+
+type mp4Track struct {
+	id        uint32
+	handler   string // "vide", "soun", ...
+	timescale uint32
+	trak      mp4Box
+	samples   []mp4Sample
+}
+
+// maxSampleTable bounds the sample tables read into memory.
+const maxSampleTable = 64 << 20
+
+// readMP4Tracks parses the sample tables of every track of a progressive
+// (non-fragmented) file.
+func readMP4Tracks(r io.ReaderAt, size int64) (mp4Box, []*mp4Track, error) {
+	top, err := readMP4Boxes(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return mp4Box{}, nil, err
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return mp4Box{}, nil, errNoMoov
+	}
+	children, err := mp4Children(r, moov)
+	if err != nil {
+		return moov, nil, err
+	}
+
+	var tracks []*mp4Track
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		t, err := readMP4Track(r, trak)
+		if err != nil {
+			return moov, nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return moov, tracks, nil
+}
+
+func readMP4Track(r io.ReaderAt, trak mp4Box) (*mp4Track, error) {
+	t := &mp4Track{trak: trak, id: mp4TrackID(r, trak)}
+	if mdhd, ok := mp4Path(r, trak, "mdia", "mdhd"); ok {
+		data, err := readMP4BoxData(r, mdhd, 1024)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) >= 24 && data[0] == 1 {
+			t.timescale = binary.BigEndian.Uint32(data[20:24])
+		} else if len(data) >= 16 {
+			t.timescale = binary.BigEndian.Uint32(data[12:16])
+		}
+	}
+	if hdlr, ok := mp4Path(r, trak, "mdia", "hdlr"); ok {
+		data, err := readMP4BoxData(r, hdlr, 1024)
+		if err == nil && len(data) >= 12 {
+			t.handler = string(data[8:12])
+		}
+	}
+
+	stbl, ok := mp4Path(r, trak, "mdia", "minf", "stbl")
+	if !ok {
+		return t, nil
+	}
+	boxes, err := mp4Children(r, stbl)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string][]byte)
+	for _, b := range boxes {
+		switch b.typ {
+		case "stts", "ctts", "stss", "stsz", "stz2", "stsc", "stco", "co64":
+			data, err := readMP4BoxData(r, b, maxSampleTable)
+			if err != nil {
+				return nil, err
+			}
+			tables[b.typ] = data
+		}
+	}
+	t.samples, err = buildMP4Samples(tables)
+	return t, err
+}
+
+// mp4TrackID reads the track id from tkhd, 0 if there is none.
+func mp4TrackID(r io.ReaderAt, trak mp4Box) uint32 {
+	tkhd, ok := mp4Path(r, trak, "tkhd")
+	if !ok {
+		return 0
+	}
+	data, err := readMP4BoxData(r, tkhd, 1024)
+	if err != nil {
+		return 0
+	}
+	if len(data) >= 24 && data[0] == 1 {
+		return binary.BigEndian.Uint32(data[20:24])
+	} else if len(data) >= 16 {
+		return binary.BigEndian.Uint32(data[12:16])
+	}
+	return 0
+}
+
+var errSampleTable = errors.New("mp4: malformed sample table")
+
+// mp4Entries returns the entry count and entries of a full box table.
+func mp4Entries(data []byte, skip, entrySize int) (int, []byte, error) {
+	if len(data) < 4+skip+4 {
+		return 0, nil, errSampleTable
+	}
+	n := int(binary.BigEndian.Uint32(data[4+skip : 8+skip]))
+	entries := data[8+skip:]
+	if entrySize > 0 && (n < 0 || len(entries)/entrySize < n) {
+		return 0, nil, errSampleTable
+	}
+	return n, entries, nil
+}
+
+func buildMP4Samples(tables map[string][]byte) ([]mp4Sample, error) {
+	// Sizes
+	var sizes []uint32
+	if data, ok := tables["stsz"]; ok {
+		if len(data) < 12 {
+			return nil, errSampleTable
+		}
+		fixed := binary.BigEndian.Uint32(data[4:8])
+		n, entries, err := mp4Entries(data, 4, 0)
+		if err != nil {
+			return nil, err
+		}
+		if fixed == 0 && len(entries)/4 < n {
+			return nil, errSampleTable
+		}
+		// With a fixed size the count is not backed by table entries, so
+		// bound it by what a table of explicit sizes could hold
+		if n > maxSampleTable/4 {
+			return nil, errSampleTable
+		}
+		sizes = make([]uint32, n)
+		for i := range sizes {
+			if fixed != 0 {
+				sizes[i] = fixed
+			} else {
+				sizes[i] = binary.BigEndian.Uint32(entries[i*4:])
+			}
+		}
+	} else if data, ok := tables["stz2"]; ok {
+		if len(data) < 12 {
+			return nil, errSampleTable
+		}
+		field := int(data[7])
+		n, entries, err := mp4Entries(data, 4, 0)
+		if err != nil {
+			return nil, err
+		}
+		if field != 4 && field != 8 && field != 16 || len(entries)*8/field < n {
+			return nil, errSampleTable
+		}
+		sizes = make([]uint32, n)
+		for i := range sizes {
+			switch field {
+			case 4:
+				b := entries[i/2]
+				if i%2 == 0 {
+					sizes[i] = uint32(b >> 4)
+				} else {
+					sizes[i] = uint32(b & 0x0f)
+				}
+			case 8:
+				sizes[i] = uint32(entries[i])
+			case 16:
+				sizes[i] = uint32(binary.BigEndian.Uint16(entries[i*2:]))
+			}
+		}
+	}
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+	samples := make([]mp4Sample, len(sizes))
+	for i, s := range sizes {
+		samples[i].size = s
+		samples[i].sync = true
+	}
+
+	// Offsets: chunks from stco/co64, samples per chunk from stsc
+	var chunks []int64
+	if data, ok := tables["stco"]; ok {
+		n, entries, err := mp4Entries(data, 0, 4)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(entries[i*4:])))
+		}
+	} else if data, ok := tables["co64"]; ok {
+		n, entries, err := mp4Entries(data, 0, 8)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(entries[i*8:])))
+		}
+	}
+	n, stsc, err := mp4Entries(tables["stsc"], 0, 12)
+	if err != nil {
+		return nil, err
+	}
+	sample := 0
+	for i := 0; i < n && sample < len(samples); i++ {
+		first := int(binary.BigEndian.Uint32(stsc[i*12:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(stsc[i*12+4:]))
+		last := len(chunks)
+		if i+1 < n {
+			last = int(binary.BigEndian.Uint32(stsc[(i+1)*12:])) - 1
+		}
+		if first < 0 || last > len(chunks) {
+			return nil, errSampleTable
+		}
+		for c := first; c < last && sample < len(samples); c++ {
+			off := chunks[c]
+			for k := 0; k < perChunk && sample < len(samples); k++ {
+				samples[sample].offset = off
+				off += int64(samples[sample].size)
+				sample++
+			}
+		}
+	}
+	if sample < len(samples) {
+		return nil, errSampleTable
+	}
+
+	// Decoding times
+	n, stts, err := mp4Entries(tables["stts"], 0, 8)
+	if err != nil {
+		return nil, err
+	}
+	sample = 0
+	var dts uint64
+	for i := 0; i < n; i++ {
+		count := int(binary.BigEndian.Uint32(stts[i*8:]))
+		delta := binary.BigEndian.Uint32(stts[i*8+4:])
+		for k := 0; k < count && sample < len(samples); k++ {
+			samples[sample].dts = dts
+			samples[sample].duration = delta
+			dts += uint64(delta)
+			sample++
+		}
+	}
+
+	// Composition offsets; version 1 tables are signed
+	if data, ok := tables["ctts"]; ok {
+		n, entries, err := mp4Entries(data, 0, 8)
+		if err != nil {
+			return nil, err
+		}
+		sample = 0
+		for i := 0; i < n; i++ {
+			count := int(binary.BigEndian.Uint32(entries[i*8:]))
+			offset := int32(binary.BigEndian.Uint32(entries[i*8+4:]))
+			for k := 0; k < count && sample < len(samples); k++ {
+				samples[sample].cto = offset
+				sample++
+			}
+		}
+	}
+
+	// Sync samples; without stss every sample is a keyframe
+	if data, ok := tables["stss"]; ok {
+		n, entries, err := mp4Entries(data, 0, 4)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i].sync = false
+		}
+		for i := 0; i < n; i++ {
+			if k := int(binary.BigEndian.Uint32(entries[i*4:])) - 1; k >= 0 && k < len(samples) {
+				samples[k].sync = true
+			}
+		}
+	}
+	return samples, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// fullBox builds the payload of a full box: version/flags followed by
+// big-endian 32-bit fields.
+func fullBox(fields ...uint32) []byte {
+	data := make([]byte, 4)
+	for _, f := range fields {
+		data = binary.BigEndian.AppendUint32(data, f)
+	}
+	return data
+}
+
+func TestBuildMP4SamplesFixedSizeCount(t *testing.T) {
+	tables := map[string][]byte{
+		"stsz": fullBox(100, 0xFFFFFFFF),
+		"stco": fullBox(1, 48),
+		"stsc": fullBox(1, 1, 3, 1),
+		"stts": fullBox(1, 3, 1000),
+	}
+	if _, err := buildMP4Samples(tables); err != errSampleTable {
+		t.Fatalf("got %v, want errSampleTable", err)
+	}
+
+	tables["stsz"] = fullBox(100, 3)
+	samples, err := buildMP4Samples(tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || samples[2].size != 100 || samples[2].offset != 248 {
+		t.Fatalf("got %+v, want 3 samples of 100 bytes from offset 48", samples)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kodi/Jellyfin metadata: <movie>, <episodedetails> or <musicvideo> NFO
+// files next to the video, plus the artwork those servers use.
+
+type nfoActor struct {
+	Name  string `xml:"name"`
+	Role  string `xml:"role"`
+	Thumb string `xml:"thumb"`
+}
+
+type nfoInfo struct {
+	XMLName   xml.Name
+	Title     string     `xml:"title"`
+	Plot      string     `xml:"plot"`
+	Outline   string     `xml:"outline"`
+	Premiered string     `xml:"premiered"`
+	Aired     string     `xml:"aired"`
+	Tags      []string   `xml:"tag"`
+	Genres    []string   `xml:"genre"`
+	Actors    []nfoActor `xml:"actor"`
+}
+
+var nfoCache sidecarCache
+
+// nfoPaths lists the NFO files that may describe a video, most specific
+// first. movie.nfo describes the only movie in its folder, so it only counts
+// when the video is alone there.
+func nfoPaths(videoPath string) []string {
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	paths := []string{base + ".nfo"}
+	if onlyVideoInDir(videoPath) {
+		paths = append(paths, filepath.Join(filepath.Dir(videoPath), "movie.nfo"))
+	}
+	return paths
+}
+
+// nfoArtwork lists the images that may serve as the cover of a video, most
+// specific first. Folder-wide artwork only counts for single-video folders.
+func nfoArtwork(videoPath string) []string {
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	names := []string{base + "-thumb", base + "-poster"}
+	if onlyVideoInDir(videoPath) {
+		names = append(names, filepath.Join(dir, "poster"), filepath.Join(dir, "folder"), filepath.Join(dir, "fanart"))
+	}
+	var paths []string
+	for _, name := range names {
+		for _, ext := range []string{".jpg", ".png", ".webp"} {
+			paths = append(paths, name+ext)
+		}
+	}
+	return paths
+}
+
+func loadNFO(videoPath string) *nfoInfo {
+	for _, path := range nfoPaths(videoPath) {
+		info, _ := nfoCache.load(path, func(path string) (interface{}, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			decoder := xml.NewDecoder(f)
+			decoder.Strict = false
+			var info nfoInfo
+			if err := decoder.Decode(&info); err != nil {
+				return nil, err
+			}
+			switch info.XMLName.Local {
+			case "movie", "episodedetails", "musicvideo":
+				return &info, nil
+			}
+			return nil, nil
+		}).(*nfoInfo)
+		if info != nil {
+			return info
+		}
+	}
+	return nil
+}
+
+// nfoMediaURL turns a path found in an NFO into a URL. Local paths are
+// relative to the NFO's folder and must lie inside the media directory.
+func nfoMediaURL(videoPath, ref string) string {
+	if ref == "" || strings.Contains(ref, "://") {
+		return ref
+	}
+	path := ref
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(videoPath), ref)
+	}
+	rel, err := filepath.Rel(mediaDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return mediaURL(rel)
+}
+
+// applyNFO fills a scanned video from its NFO: title and plot as the
+// description, premiere date, tags and genres as hashtags, the first actor
+// as the author, and the poster as the cover.
+func applyNFO(video map[string]interface{}, videoPath string) {
+	info := loadNFO(videoPath)
+	if info == nil {
+		return
+	}
+
+	desc := strings.TrimSpace(info.Title)
+	plot := strings.TrimSpace(info.Plot)
+	if plot == "" {
+		plot = strings.TrimSpace(info.Outline)
+	}
+	if plot != "" && plot != desc {
+		if desc == "" {
+			desc = plot
+		} else {
+			desc += "\n" + plot
+		}
+	}
+	if desc != "" {
+		video["desc"] = desc
+	}
+
+	for _, date := range []string{info.Premiered, info.Aired} {
+		if t, err := time.Parse("2006-01-02", strings.TrimSpace(date)); err == nil {
+			video["create_time"] = t.Unix()
+			break
+		}
+	}
+
+	seen := make(map[string]bool)
+	textExtra := make([]map[string]interface{}, 0, len(info.Tags)+len(info.Genres))
+	for _, tag := range append(info.Tags, info.Genres...) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		textExtra = append(textExtra, map[string]interface{}{
+			"type":         1,
+			"hashtag_name": tag,
+		})
+	}
+	if len(textExtra) > 0 {
+		video["text_extra"] = textExtra
+	}
+
+	for _, actor := range info.Actors {
+		name := strings.TrimSpace(actor.Name)
+		if name == "" {
+			continue
+		}
+		video["author"] = newLocalAuthor(name, name, nfoMediaURL(videoPath, strings.TrimSpace(actor.Thumb)))
+		break
+	}
+
+	for _, path := range nfoArtwork(videoPath) {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(mediaDir, path); err == nil {
+			if v, ok := video["video"].(map[string]interface{}); ok {
+				v["cover"] = map[string]interface{}{
+					"url_list": []string{mediaURL(rel)},
+				}
+			}
+		}
+		break
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFolderNFOOnlyForSingleVideo(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first := write("01.mp4", "")
+	write("movie.nfo", "<movie><title>Movie</title></movie>")
+	write("poster.jpg", "")
+
+	if info := loadNFO(first); info == nil || info.Title != "Movie" {
+		t.Fatalf("single video: got %+v, want movie.nfo", info)
+	}
+	if !contains(nfoArtwork(first), filepath.Join(dir, "poster.jpg")) {
+		t.Fatal("single video: poster.jpg not listed")
+	}
+
+	second := write("02.mp4", "")
+	write("02.nfo", "<episodedetails><title>Episode 2</title></episodedetails>")
+	// Make sure the folder's mtime changes even on coarse clocks
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(dir, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := loadNFO(first); info != nil {
+		t.Fatalf("two videos: got %+v for 01.mp4, want no metadata", info)
+	}
+	if info := loadNFO(second); info == nil || info.Title != "Episode 2" {
+		t.Fatalf("two videos: got %+v for 02.mp4, want 02.nfo", info)
+	}
+	for _, path := range []string{first, second} {
+		if contains(nfoArtwork(path), filepath.Join(dir, "poster.jpg")) {
+			t.Fatalf("two videos: poster.jpg listed for %s", path)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
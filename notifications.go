@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Notification types recorded in state/notifications.json.
+const (
+	noticeLike    = "like"
+	noticeComment = "comment"
+	noticeFollow  = "follow"
+	noticeMention = "mention"
+)
+
+var noticeTypes = []string{noticeLike, noticeComment, noticeFollow, noticeMention}
+
+type notice struct {
+	ID         string `json:"id"`
+	UID        string `json:"uid"`
+	Type       string `json:"type"`
+	FromUID    string `json:"from_uid"`
+	AwemeID    string `json:"aweme_id,omitempty"`
+	CommentID  string `json:"comment_id,omitempty"`
+	Content    string `json:"content,omitempty"`
+	CreateTime int64  `json:"create_time"`
+	Read       bool   `json:"read"`
+}
+
+var notices []*notice
+var noticesMu sync.Mutex
+
+func loadNoticeState() {
+	noticesMu.Lock()
+	defer noticesMu.Unlock()
+	if err := loadState("notifications", &notices); err != nil {
+		log.Printf("Failed to load notifications: %v", err)
+	}
+}
+
+// addNotice records n for its recipient and pushes the new unread counts.
+// Users are never notified about their own actions.
+func addNotice(n notice) {
+	if n.UID == "" || n.UID == n.FromUID || !knownUser(n.UID) {
+		return
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	n.ID = hex.EncodeToString(buf)
+	n.CreateTime = time.Now().Unix()
+
+	noticesMu.Lock()
+	notices = append(notices, &n)
+	if err := saveState("notifications", notices); err != nil {
+		log.Printf("Failed to save notifications: %v", err)
+	}
+	counts := unreadCounts(n.UID)
+	noticesMu.Unlock()
+
+	events.publish("notice:"+n.UID, "unread", counts)
+}
+
+// unreadCounts must be called with noticesMu held.
+func unreadCounts(uid string) map[string]int {
+	counts := map[string]int{"total": 0}
+	for _, t := range noticeTypes {
+		counts[t] = 0
+	}
+	for _, n := range notices {
+		if n.UID == uid && !n.Read {
+			counts[n.Type]++
+			counts["total"]++
+		}
+	}
+	return counts
+}
+
+// noticeListHandler pages the current user's notifications, newest first.
+// ?type= restricts the list to one notification type.
+func noticeListHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	pageNo := 0
+	pageSize := 10
+	if p := r.URL.Query().Get("pageNo"); p != "" {
+		fmt.Sscanf(p, "%d", &pageNo)
+	}
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		fmt.Sscanf(ps, "%d", &pageSize)
+	}
+	offset := pageNo * pageSize
+	noticeType := r.URL.Query().Get("type")
+
+	noticesMu.Lock()
+	var mine []notice
+	for i := len(notices) - 1; i >= 0; i-- {
+		n := notices[i]
+		if n.UID == uid && (noticeType == "" || n.Type == noticeType) {
+			mine = append(mine, *n)
+		}
+	}
+	counts := unreadCounts(uid)
+	noticesMu.Unlock()
+
+	total := len(mine)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + pageSize
+	if end > total {
+		end = total
+	}
+	if end < offset {
+		end = offset
+	}
+
+	index := videoIndex()
+	list := make([]map[string]interface{}, 0, end-offset)
+	for _, n := range mine[offset:end] {
+		item := map[string]interface{}{
+			"id":          n.ID,
+			"type":        n.Type,
+			"user":        accountAuthor(n.FromUID),
+			"content":     n.Content,
+			"comment_id":  n.CommentID,
+			"create_time": n.CreateTime,
+			"read":        n.Read,
+		}
+		if n.AwemeID != "" {
+			item["aweme_id"] = n.AwemeID
+			item["aweme"] = index[n.AwemeID]
+		}
+		list = append(list, item)
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"pageNo": pageNo,
+			"total":  total,
+			"unread": counts,
+			"list":   list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func noticeUnreadHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	noticesMu.Lock()
+	counts := unreadCounts(uid)
+	noticesMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": counts,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// noticeReadHandler marks notifications as read: the given ids, every
+// notification of one type, or everything when the body is empty.
+func noticeReadHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		IDs  []string `json:"ids"`
+		Type string   `json:"type"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	ids := make(map[string]bool)
+	for _, id := range req.IDs {
+		ids[id] = true
+	}
+
+	noticesMu.Lock()
+	for _, n := range notices {
+		if n.UID != uid || n.Read {
+			continue
+		}
+		if len(ids) > 0 && !ids[n.ID] {
+			continue
+		}
+		if req.Type != "" && n.Type != req.Type {
+			continue
+		}
+		n.Read = true
+	}
+	if err := saveState("notifications", notices); err != nil {
+		log.Printf("Failed to save notifications: %v", err)
+	}
+	counts := unreadCounts(uid)
+	noticesMu.Unlock()
+
+	events.publish("notice:"+uid, "unread", counts)
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": counts,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// noticeStreamHandler pushes "unread" events with the current unread counts
+// over SSE whenever they change.
+func noticeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	uid := requestUID(r)
+	if uid == "" {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	noticesMu.Lock()
+	counts := unreadCounts(uid)
+	noticesMu.Unlock()
+
+	serveSSE(w, r, "notice:"+uid, sseEvent("unread", counts))
+}
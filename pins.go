@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Pinned (置顶) videos. Authors pin up to pinMax of their own videos; the
+// pin time is kept in the video's catalog record.
+
+var pinMax int
+
+// markPinned sets is_top on a freshly scanned list of videos.
+func markPinned(videos []map[string]interface{}) {
+	for _, v := range videos {
+		if pinTime(idString(v["aweme_id"])) > 0 {
+			v["is_top"] = 1
+		} else {
+			v["is_top"] = 0
+		}
+	}
+}
+
+// userPinHandler pins ({"aweme_id": "...", "pin": true}) or unpins one of the
+// current user's videos.
+func userPinHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		AwemeID string `json:"aweme_id"`
+		Pin     bool   `json:"pin"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil || req.AwemeID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	path, ok := mediaPathByID(req.AwemeID)
+	if !ok {
+		// Private videos are not part of the public scan
+		privateVideos(uid)
+		path, ok = knownMediaPath(req.AwemeID)
+	}
+	owner := ""
+	if ok {
+		owner = mediaOwner(req.AwemeID, path)
+	} else if !req.Pin {
+		// Videos removed from the media directory can still be unpinned
+		catalogMu.Lock()
+		if rec := catalog[req.AwemeID]; rec != nil && rec.PinTime > 0 {
+			owner = recordOwner(rec, "")
+		}
+		catalogMu.Unlock()
+	}
+	if owner != uid {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Video not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	// Pinned private videos are only known once the private folder has
+	// been scanned
+	catalogMu.Lock()
+	var pinnedIDs []string
+	for id, rec := range catalog {
+		if rec.PinTime > 0 {
+			pinnedIDs = append(pinnedIDs, id)
+		}
+	}
+	catalogMu.Unlock()
+	for _, id := range pinnedIDs {
+		if _, ok := knownMediaPath(id); !ok {
+			privateVideos(uid)
+			break
+		}
+	}
+
+	catalogMu.Lock()
+	pinned := 0
+	for id, rec := range catalog {
+		if rec.PinTime == 0 || id == req.AwemeID {
+			continue
+		}
+		// Pins of videos that are gone do not count
+		pinPath, ok := knownMediaPath(id)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(pinPath); err != nil {
+			continue
+		}
+		// Owner-less records belong to whoever owns the file
+		if recordOwner(rec, pinPath) == uid {
+			pinned++
+		}
+	}
+	if req.Pin && pinned >= pinMax {
+		catalogMu.Unlock()
+		finalResp := map[string]interface{}{
+			"code": 400,
+			"msg":  fmt.Sprintf("At most %d videos can be pinned", pinMax),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+	rec := catalog[req.AwemeID]
+	if rec == nil {
+		// Record the owner too, so the pin stays with them
+		rec = &catalogRecord{Owner: uid}
+		catalog[req.AwemeID] = rec
+	} else if rec.Owner == "" {
+		rec.Owner = uid
+	}
+	if req.Pin {
+		rec.PinTime = time.Now().Unix()
+	} else {
+		rec.PinTime = 0
+	}
+	saveCatalogState()
+	catalogMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"is_top": req.Pin,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
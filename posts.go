@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var postsDir string
+
+// postsMode controls how local Markdown posts are combined with data/posts.json:
+// "merge" lists both sorted by date, "replace" hides the mock posts entirely.
+var postsMode string
+
+// postFrontMatter holds the supported front-matter keys of a Markdown post.
+type postFrontMatter struct {
+	Title  string
+	Author string
+	Cover  string
+	Tags   []string
+	Date   time.Time
+}
+
+var postDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// scanLocalPosts reads every .md file below postsDir and renders it into the
+// same aweme shape as the mock posts, newest first.
+func scanLocalPosts() []map[string]interface{} {
+	type datedPost struct {
+		date time.Time
+		post map[string]interface{}
+	}
+	var dated []datedPost
+
+	err := filepath.WalkDir(postsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == postsDir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".md") {
+			return nil
+		}
+		post, date, err := loadMarkdownPost(path)
+		if err != nil {
+			log.Printf("Failed to load post %s: %v", path, err)
+			return nil
+		}
+		dated = append(dated, datedPost{date: date, post: post})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to scan posts: %v", err)
+	}
+
+	sort.SliceStable(dated, func(i, j int) bool {
+		return dated[i].date.After(dated[j].date)
+	})
+	posts := make([]map[string]interface{}, 0, len(dated))
+	for _, p := range dated {
+		posts = append(posts, p.post)
+	}
+	return posts
+}
+
+// recommendedPosts returns the list served by /post/recommended, newest
+// first. In merge mode the mock posts are sorted in by their create_time.
+func recommendedPosts() []map[string]interface{} {
+	local := scanLocalPosts()
+	if postsMode == "replace" {
+		return local
+	}
+	posts := make([]map[string]interface{}, 0, len(local)+len(jsonPosts))
+	posts = append(posts, local...)
+	posts = append(posts, jsonPosts...)
+	sort.SliceStable(posts, func(i, j int) bool {
+		return toInt(posts[i]["create_time"]) > toInt(posts[j]["create_time"])
+	})
+	return posts
+}
+
+func loadMarkdownPost(path string) (map[string]interface{}, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	relPath, err := filepath.Rel(postsDir, path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	meta, body := parseFrontMatter(data)
+
+	if meta.Title == "" {
+		meta.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if meta.Date.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			meta.Date = info.ModTime()
+		}
+	}
+
+	hash := md5.Sum([]byte("post:" + filepath.ToSlash(relPath)))
+	id := hex.EncodeToString(hash[:])
+
+	// Relative image references resolve against the post's own folder and
+	// must stay inside postsDir; others are dropped.
+	postDir := filepath.Dir(relPath)
+	resolve := func(ref string) (string, string) {
+		if ref == "" || strings.Contains(ref, "://") || strings.HasPrefix(ref, "/") {
+			return ref, ""
+		}
+		localPath := filepath.Join(postsDir, postDir, filepath.FromSlash(ref))
+		rel, err := filepath.Rel(postsDir, localPath)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", ""
+		}
+		return fileURL("/posts/", rel), localPath
+	}
+
+	var images []map[string]interface{}
+	seen := make(map[string]bool)
+	addImage := func(ref string) string {
+		imageUrl, localPath := resolve(ref)
+		if imageUrl == "" {
+			return ""
+		}
+		if seen[imageUrl] {
+			return imageUrl
+		}
+		seen[imageUrl] = true
+		width, height := 0, 0
+		if localPath != "" {
+			width, height = imageSize(localPath)
+		}
+		images = append(images, map[string]interface{}{
+			"uri":               fmt.Sprintf("%s_%d", id, len(images)),
+			"url_list":          []string{imageUrl},
+			"download_url_list": []string{imageUrl},
+			"width":             width,
+			"height":            height,
+		})
+		return imageUrl
+	}
+
+	coverUrl := ""
+	if meta.Cover != "" {
+		coverUrl = addImage(meta.Cover)
+	}
+	content := renderMarkdown(body, addImage)
+	if coverUrl == "" && len(images) > 0 {
+		coverUrl = images[0]["url_list"].([]string)[0]
+	}
+
+	post := newLocalVideo(id, meta.Title, "", coverUrl)
+	post["create_time"] = meta.Date.Unix()
+	post["content"] = content
+	post["author"] = postAuthor(meta.Author)
+
+	textExtra := make([]map[string]interface{}, 0, len(meta.Tags))
+	for _, tag := range meta.Tags {
+		textExtra = append(textExtra, map[string]interface{}{
+			"type":         1,
+			"hashtag_name": tag,
+		})
+	}
+	post["text_extra"] = textExtra
+
+	video := post["video"].(map[string]interface{})
+	video["play_addr"].(map[string]interface{})["url_list"] = []string{}
+	if len(images) > 0 {
+		post["aweme_type"] = awemeTypeAlbum
+		post["images"] = images
+		video["width"] = images[0]["width"]
+		video["height"] = images[0]["height"]
+	}
+	return post, meta.Date, nil
+}
+
+// postAuthor looks the author up in users.json by uid or nickname, falling back
+// to a local author carrying the given name.
+func postAuthor(name string) interface{} {
+	if name != "" {
+		if user, ok := jsonUsers[name]; ok {
+			return user
+		}
+		for _, u := range jsonUsersList {
+			if nickname, ok := u["nickname"].(string); ok && nickname == name {
+				return u
+			}
+		}
+	}
+	if name == "" {
+		return newLocalAuthor(localUID, "Local User", "")
+	}
+	return newLocalAuthor(name, name, "")
+}
+
+// parseFrontMatter splits a leading "---" delimited block from the document.
+// Only the flat "key: value" subset of YAML is understood, plus tag lists in
+// either "[a, b]" or "- a" form.
+func parseFrontMatter(data []byte) (postFrontMatter, []byte) {
+	var meta postFrontMatter
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(data, []byte("---")) {
+		return meta, data
+	}
+	rest := data[3:]
+	end := bytes.Index(rest, []byte("\n---"))
+	if end < 0 {
+		return meta, data
+	}
+	header := rest[:end]
+	body := rest[end+4:]
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		body = body[i+1:]
+	} else {
+		body = nil
+	}
+
+	lastKey := ""
+	scanner := bufio.NewScanner(bytes.NewReader(header))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && lastKey == "tags" {
+			meta.Tags = append(meta.Tags, unquote(strings.TrimSpace(trimmed[2:])))
+			continue
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		lastKey = key
+		switch key {
+		case "title":
+			meta.Title = unquote(value)
+		case "author":
+			meta.Author = unquote(value)
+		case "cover":
+			meta.Cover = unquote(value)
+		case "tags":
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+			for _, tag := range strings.Split(value, ",") {
+				if tag = unquote(strings.TrimSpace(tag)); tag != "" {
+					meta.Tags = append(meta.Tags, tag)
+				}
+			}
+		case "date":
+			value = unquote(value)
+			for _, layout := range postDateLayouts {
+				if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+					meta.Date = t
+					break
+				}
+			}
+		}
+	}
+	return meta, body
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+var (
+	mdImage  = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)[^)]*\)`)
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	mdBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdItalic = regexp.MustCompile(`\*([^*]+)\*`)
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdList   = regexp.MustCompile(`^\s*([-*+]|\d+\.)\s+`)
+)
+
+// renderMarkdown converts the common Markdown subset used in posts to HTML:
+// headings, paragraphs, lists, quotes, fenced code, images, links and
+// emphasis. Every image source is passed through addImage, which returns the
+// URL to embed.
+func renderMarkdown(src []byte, addImage func(string) string) string {
+	var out strings.Builder
+	var para []string
+	listTag := "" // "ul" or "ol" while in a list
+	inCode := false
+
+	flushPara := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(para, " "), addImage) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if listTag != "" {
+			out.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") {
+			flushPara()
+			closeList()
+			if inCode {
+				out.WriteString("</code></pre>\n")
+			} else {
+				out.WriteString("<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case strings.HasPrefix(trimmed, "#"):
+			flushPara()
+			closeList()
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 6 {
+				level = 6
+			}
+			text := strings.TrimSpace(trimmed[level:])
+			out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, renderInline(text, addImage), level))
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			closeList()
+			text := strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))
+			out.WriteString("<blockquote>" + renderInline(text, addImage) + "</blockquote>\n")
+		case mdList.MatchString(line):
+			flushPara()
+			tag := "ul"
+			if strings.HasSuffix(mdList.FindStringSubmatch(line)[1], ".") {
+				tag = "ol"
+			}
+			if listTag != tag {
+				closeList()
+				out.WriteString("<" + tag + ">\n")
+				listTag = tag
+			}
+			text := mdList.ReplaceAllString(line, "")
+			out.WriteString("<li>" + renderInline(text, addImage) + "</li>\n")
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+	closeList()
+	if inCode {
+		out.WriteString("</code></pre>\n")
+	}
+	return out.String()
+}
+
+// renderInline renders the inline Markdown of one block. Code spans, image
+// tags and link targets are swapped for placeholders while emphasis is
+// applied, so a * in a URL or in code stays literal.
+func renderInline(text string, addImage func(string) string) string {
+	var saved []string
+	protect := func(s string) string {
+		saved = append(saved, s)
+		return fmt.Sprintf("\x00%d\x00", len(saved)-1)
+	}
+
+	text = html.EscapeString(strings.ReplaceAll(text, "\x00", ""))
+	text = mdCode.ReplaceAllStringFunc(text, func(m string) string {
+		return protect("<code>" + mdCode.FindStringSubmatch(m)[1] + "</code>")
+	})
+	text = mdImage.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdImage.FindStringSubmatch(m)
+		src := addImage(html.UnescapeString(parts[2]))
+		if src == "" {
+			return protect(parts[1])
+		}
+		return protect(fmt.Sprintf(`<img src="%s" alt="%s">`, html.EscapeString(src), parts[1]))
+	})
+	text = mdLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdLink.FindStringSubmatch(m)
+		href := html.UnescapeString(parts[2])
+		if !safeLinkURL(href) {
+			return parts[1]
+		}
+		return protect(`<a href="`+html.EscapeString(href)+`">`) + parts[1] + "</a>"
+	})
+	text = mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = mdItalic.ReplaceAllString(text, "<em>$1</em>")
+
+	return mdPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		n, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+		return saved[n]
+	})
+}
+
+var mdPlaceholder = regexp.MustCompile("\x00(\\d+)\x00")
+
+// safeLinkURL allows http, https and mailto links and relative URLs, so a
+// post cannot carry javascript: or data: links.
+func safeLinkURL(href string) bool {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
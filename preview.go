@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Animated previews: a few muted seconds of each local video, shown in
+// profile grids on hover. They are cut in the background by thumbnailerPath
+// from a tenth of the way into the video and kept in cacheDir/preview as MP4
+// or animated WebP (--preview-format).
+
+const (
+	previewSeconds = 3
+	// Previews are this many pixels on their longer side
+	previewSize = 320
+)
+
+var previewFormat string
+
+var previewQueue = newFileQueue()
+
+func previewPath(awemeID, path string) (string, error) {
+	version, err := fileVersion(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "preview", awemeID+"-"+version+"."+previewFormat), nil
+}
+
+func startPreviews() {
+	if previewFormat != "webp" {
+		previewFormat = "mp4"
+	}
+	if thumbnailerPath == "" {
+		return
+	}
+	previewQueue.start("Preview", makePreview)
+}
+
+// applyPreview points dynamic_cover at the animated preview of a video once
+// it exists, and queues it otherwise.
+func applyPreview(video map[string]interface{}, awemeID, path string) {
+	dest, err := previewPath(awemeID, path)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(dest); err != nil {
+		if thumbnailerPath != "" {
+			previewQueue.add(path)
+		}
+		return
+	}
+	if v, ok := video["video"].(map[string]interface{}); ok {
+		v["dynamic_cover"] = map[string]interface{}{
+			"uri":      awemeID + "_preview",
+			"url_list": []string{"/preview/" + awemeID},
+		}
+	}
+}
+
+// makePreview cuts the preview clip of a video.
+func makePreview(path string) error {
+	rel, err := filepath.Rel(mediaDir, path)
+	if err != nil {
+		return err
+	}
+	dest, err := previewPath(mediaID(rel), path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	start := 0.0
+	scale := fmt.Sprintf("scale=%d:-2", previewSize)
+	if probe := probeMedia(path); probe != nil {
+		start = math.Max(0, math.Min(probe.Duration/10, probe.Duration-previewSeconds))
+		if probe.Height > probe.Width {
+			scale = fmt.Sprintf("scale=-2:%d", previewSize)
+		}
+	}
+
+	args := []string{
+		"-hide_banner", "-nostdin", "-loglevel", "error",
+		"-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprint(previewSeconds),
+		"-i", path,
+		"-an",
+	}
+	if previewFormat == "webp" {
+		args = append(args, "-vf", "fps=12,"+scale, "-c:v", "libwebp", "-loop", "0", "-q:v", "60")
+	} else {
+		args = append(args, "-vf", scale, "-c:v", "libx264", "-preset", "veryfast", "-crf", "28",
+			"-pix_fmt", "yuv420p", "-movflags", "+faststart")
+	}
+	// Keep the extension, ffmpeg picks the output format from it
+	tmp := strings.TrimSuffix(dest, "."+previewFormat) + ".tmp." + previewFormat
+	defer os.Remove(tmp)
+	cmd := exec.Command(thumbnailerPath, append(args, "-y", tmp)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, dest)
+}
+
+// previewHandler serves /preview/<aweme_id>.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	awemeID := strings.TrimPrefix(r.URL.Path, "/preview/")
+	path, ok := localMediaPath(r, awemeID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	dest, err := previewPath(awemeID, path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := os.Stat(dest); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, dest)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Private videos live in mediaDir/<privateDir>/<uid>/. They are left out of
+// every public listing, listed to their owner by /video/private, and their
+// /media/ URLs only answer to the owner's session.
+
+var privateDir string
+
+// privateRoot returns the private folder on disk, or "" when disabled.
+func privateRoot() string {
+	if privateDir == "" {
+		return ""
+	}
+	return filepath.Join(mediaDir, privateDir)
+}
+
+func isPrivateRoot(dir string) bool {
+	root := privateRoot()
+	return root != "" && filepath.Clean(dir) == filepath.Clean(root)
+}
+
+// privateOwner reports whether a path relative to mediaDir, in URL form,
+// lies in the private folder, and whose folder it is in. The comparison
+// ignores case so case-insensitive file systems cannot be used to slip past
+// it.
+func privateOwner(urlPath string) (string, bool) {
+	if privateDir == "" {
+		return "", false
+	}
+	segments := strings.Split(strings.TrimPrefix(path.Clean("/"+urlPath), "/"), "/")
+	prefix := strings.Split(filepath.ToSlash(filepath.Clean(privateDir)), "/")
+	if len(segments) < len(prefix) {
+		return "", false
+	}
+	for i, p := range prefix {
+		if !strings.EqualFold(segments[i], p) {
+			return "", false
+		}
+	}
+	if len(segments) == len(prefix) {
+		// The private folder itself belongs to nobody
+		return "", true
+	}
+	return segments[len(prefix)], true
+}
+
+// privateVideos lists the private videos of uid.
+func privateVideos(uid string) ([]map[string]interface{}, error) {
+	root := privateRoot()
+	if root == "" || uid == "" || strings.ContainsAny(uid, `/\`) || uid == "." || uid == ".." {
+		return nil, nil
+	}
+	videos, err := scanVideoTree(filepath.Join(root, uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range videos {
+		v["author"] = accountAuthor(uid)
+	}
+	return videos, nil
+}
+
+// privateMediaGuard answers 404 for files in the private folder unless the
+// request carries the owner's session. Since <video> elements cannot send
+// headers, the session may also come from the token cookie or ?token=.
+func privateMediaGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if owner, ok := privateOwner(r.URL.Path); ok {
+			a := requestUser(r)
+			if a == nil || owner == "" || a.UID != owner {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"os"
+	"time"
+)
+
+// mediaProbe is what the scanner learns from a media file's container
+// headers.
+type mediaProbe struct {
+	Container string
+	Duration  float64 // seconds
+	Width     int
+	Height    int
+	// Codecs of the first video and audio track, see codecFamily
+	VideoCodec string
+	AudioCodec string
+	// MoovAtEnd is set for MP4s whose moov box comes after mdat
+	MoovAtEnd bool
+	// CaptureTime is when the video was shot, zero when unknown
+	CaptureTime time.Time
+	Location    *geoLocation
+}
+
+var probeCache sidecarCache
+
+// probeMedia reads the container headers of a video, or returns nil when the
+// format is unsupported or the file is unreadable.
+func probeMedia(path string) *mediaProbe {
+	probe, _ := probeCache.load(path, func(path string) (interface{}, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		format := mediaFormatFor(path)
+		if format == nil {
+			return nil, nil
+		}
+		switch format.Container {
+		case "webm":
+			return probeWebM(f, stat.Size())
+		case "mp4":
+			return probeMP4(f, stat.Size())
+		}
+		return nil, nil
+	}).(*mediaProbe)
+	return probe
+}
+
+// applyProbe sets the duration and size of a scanned video from its headers.
+// Landscape videos are flagged with horizontal_type so players can letterbox
+// them.
+func applyProbe(video map[string]interface{}, path string) {
+	probe := probeMedia(path)
+	if probe == nil {
+		return
+	}
+	v, ok := video["video"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if probe.Duration > 0 {
+		// Douyin durations are in milliseconds
+		ms := int(math.Round(probe.Duration * 1000))
+		video["duration"] = ms
+		v["duration"] = ms
+	}
+	if probe.Width > 0 && probe.Height > 0 {
+		v["width"] = probe.Width
+		v["height"] = probe.Height
+		if playAddr, ok := v["play_addr"].(map[string]interface{}); ok {
+			playAddr["width"] = probe.Width
+			playAddr["height"] = probe.Height
+		}
+		if probe.Width > probe.Height {
+			video["horizontal_type"] = 1
+		} else {
+			video["horizontal_type"] = 0
+		}
+	}
+}
+
+// videoDurationMs returns the duration of a video map in milliseconds.
+func videoDurationMs(video map[string]interface{}) int {
+	return toInt(video["duration"])
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shopDir holds a local product catalog: goods.json and/or *.csv files plus
+// the product images they reference. When it yields any goods they replace
+// the mock data/goods.json.
+var shopDir string
+
+// Simulated order lifecycle. Checkout always "pays" immediately, then orders
+// move on by themselves as time passes.
+const (
+	orderStatusPaid      = "paid"
+	orderStatusShipped   = "shipped"
+	orderStatusCompleted = "completed"
+	orderStatusCancelled = "cancelled"
+
+	orderShipAfter     = 2 * time.Minute
+	orderCompleteAfter = 10 * time.Minute
+)
+
+type cartItem struct {
+	GoodsID string `json:"goods_id"`
+	Count   int    `json:"count"`
+}
+
+type orderItem struct {
+	GoodsID string      `json:"goods_id"`
+	Name    string      `json:"name"`
+	Cover   interface{} `json:"cover"`
+	Price   float64     `json:"price"`
+	Count   int         `json:"count"`
+}
+
+type order struct {
+	OrderID    string      `json:"order_id"`
+	UID        string      `json:"uid"`
+	Items      []orderItem `json:"items"`
+	TotalPrice float64     `json:"total_price"`
+	Status     string      `json:"status"`
+	CreateTime int64       `json:"create_time"`
+	UpdateTime int64       `json:"update_time"`
+}
+
+// shopState is persisted as state/shop.json.
+type shopState struct {
+	Carts  map[string][]cartItem `json:"carts"`
+	Orders []*order              `json:"orders"`
+}
+
+var shop = shopState{Carts: make(map[string][]cartItem)}
+var shopMu sync.Mutex
+
+func loadShopState() {
+	shopMu.Lock()
+	defer shopMu.Unlock()
+	if err := loadState("shop", &shop); err != nil {
+		log.Printf("Failed to load shop state: %v", err)
+	}
+	if shop.Carts == nil {
+		shop.Carts = make(map[string][]cartItem)
+	}
+}
+
+// saveShopState must be called with shopMu held.
+func saveShopState() {
+	if err := saveState("shop", &shop); err != nil {
+		log.Printf("Failed to save shop state: %v", err)
+	}
+}
+
+// shopGoods returns the catalog served by the shop tab: the local catalog if
+// it has any goods, otherwise the mock goods.
+func shopGoods() []map[string]interface{} {
+	if local := loadLocalGoods(); len(local) > 0 {
+		return local
+	}
+	return jsonGoods
+}
+
+// goodsID returns the id of a catalog entry, falling back to its position for
+// entries without one (the mock goods have no ids).
+func goodsID(i int, item map[string]interface{}) string {
+	switch v := item["id"].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.Itoa(i)
+}
+
+func findGoods(goods []map[string]interface{}, id string) map[string]interface{} {
+	for i, item := range goods {
+		if goodsID(i, item) == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func goodsPrice(item map[string]interface{}) float64 {
+	switch v := item["price"].(type) {
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+func goodsName(item map[string]interface{}) string {
+	for _, key := range []string{"name", "title", "desc"} {
+		if v, ok := item[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var goodsImageFields = []string{"cover", "imgs", "images"}
+
+// loadLocalGoods reads goods.json and every CSV file in shopDir. CSV files use
+// their header row as field names; list fields such as imgs are separated by
+// "|". Relative image paths are rewritten to /shop/assets/ URLs, and goods
+// without any image pick up images/<id>.jpg (or .png/.webp) when present.
+func loadLocalGoods() []map[string]interface{} {
+	var goods []map[string]interface{}
+
+	if data, err := os.ReadFile(filepath.Join(shopDir, "goods.json")); err == nil {
+		var list []map[string]interface{}
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Printf("Failed to parse shop goods.json: %v", err)
+		} else {
+			goods = append(goods, list...)
+		}
+	}
+
+	csvFiles, _ := filepath.Glob(filepath.Join(shopDir, "*.csv"))
+	sort.Strings(csvFiles)
+	for _, path := range csvFiles {
+		list, err := readGoodsCSV(path)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", path, err)
+			continue
+		}
+		goods = append(goods, list...)
+	}
+
+	for i, item := range goods {
+		id := goodsID(i, item)
+		item["id"] = id
+		hasImage := false
+		for _, field := range goodsImageFields {
+			switch v := item[field].(type) {
+			case string:
+				item[field] = shopAssetURL(v)
+				hasImage = hasImage || v != ""
+			case []interface{}:
+				for j, s := range v {
+					if s, ok := s.(string); ok {
+						v[j] = shopAssetURL(s)
+						hasImage = true
+					}
+				}
+			}
+		}
+		if !hasImage {
+			for _, ext := range []string{".jpg", ".png", ".webp"} {
+				rel := filepath.Join("images", id+ext)
+				if _, err := os.Stat(filepath.Join(shopDir, rel)); err == nil {
+					item["cover"] = fileURL("/shop/assets/", rel)
+					break
+				}
+			}
+		}
+	}
+	return goods
+}
+
+func readGoodsCSV(path string) ([]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil
+	}
+	header := records[0]
+	header[0] = strings.TrimPrefix(header[0], "\xef\xbb\xbf")
+
+	var goods []map[string]interface{}
+	for _, record := range records[1:] {
+		item := make(map[string]interface{})
+		for i, value := range record {
+			if i >= len(header) {
+				break
+			}
+			key := strings.TrimSpace(header[i])
+			value = strings.TrimSpace(value)
+			switch {
+			case key == "id":
+				item[key] = value
+			case key == "imgs" || key == "images" || key == "tags":
+				var list []interface{}
+				for _, part := range strings.Split(value, "|") {
+					if part = strings.TrimSpace(part); part != "" {
+						list = append(list, part)
+					}
+				}
+				if len(list) > 0 {
+					item[key] = list
+				}
+			default:
+				if f, err := strconv.ParseFloat(value, 64); err == nil {
+					item[key] = f
+				} else {
+					item[key] = value
+				}
+			}
+		}
+		goods = append(goods, item)
+	}
+	return goods, nil
+}
+
+func shopAssetURL(ref string) string {
+	if ref == "" || strings.Contains(ref, "://") || strings.HasPrefix(ref, "/") {
+		return ref
+	}
+	return fileURL("/shop/assets/", filepath.FromSlash(ref))
+}
+
+// advanceOrders moves orders along the simulated lifecycle. It must be called
+// with shopMu held and reports whether anything changed.
+func advanceOrders(now time.Time) bool {
+	changed := false
+	for _, o := range shop.Orders {
+		age := now.Sub(time.Unix(o.CreateTime, 0))
+		next := o.Status
+		if next == orderStatusPaid && age >= orderShipAfter {
+			next = orderStatusShipped
+		}
+		if next == orderStatusShipped && age >= orderCompleteAfter {
+			next = orderStatusCompleted
+		}
+		if next != o.Status {
+			o.Status = next
+			o.UpdateTime = now.Unix()
+			changed = true
+		}
+	}
+	return changed
+}
+
+func shopCartHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	goods := shopGoods()
+	shopMu.Lock()
+	cart := append([]cartItem(nil), shop.Carts[uid]...)
+	shopMu.Unlock()
+
+	list := make([]map[string]interface{}, 0, len(cart))
+	totalPrice := 0.0
+	for _, c := range cart {
+		item := findGoods(goods, c.GoodsID)
+		if item == nil {
+			continue
+		}
+		totalPrice += goodsPrice(item) * float64(c.Count)
+		list = append(list, map[string]interface{}{
+			"goods_id": c.GoodsID,
+			"count":    c.Count,
+			"goods":    item,
+		})
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"total":       len(list),
+			"total_price": totalPrice,
+			"list":        list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func shopCartAddHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req cartItem
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Count <= 0 {
+		req.Count = 1
+	}
+	if findGoods(shopGoods(), req.GoodsID) == nil {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Goods not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	shopMu.Lock()
+	cart := shop.Carts[uid]
+	found := false
+	for i := range cart {
+		if cart[i].GoodsID == req.GoodsID {
+			cart[i].Count += req.Count
+			found = true
+			break
+		}
+	}
+	if !found {
+		cart = append(cart, req)
+	}
+	shop.Carts[uid] = cart
+	saveShopState()
+	shopMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func shopCartRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	// A count of zero removes the goods from the cart entirely
+	var req cartItem
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shopMu.Lock()
+	cart := shop.Carts[uid]
+	kept := cart[:0]
+	for _, c := range cart {
+		if c.GoodsID == req.GoodsID {
+			if req.Count <= 0 || c.Count <= req.Count {
+				continue
+			}
+			c.Count -= req.Count
+		}
+		kept = append(kept, c)
+	}
+	shop.Carts[uid] = kept
+	saveShopState()
+	shopMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func shopCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	// Without goods_ids the whole cart is checked out
+	var req struct {
+		GoodsIDs []string `json:"goods_ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(r, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	selected := make(map[string]bool)
+	for _, id := range req.GoodsIDs {
+		selected[id] = true
+	}
+
+	goods := shopGoods()
+	now := time.Now()
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	o := &order{
+		OrderID:    fmt.Sprintf("%d%s", now.Unix(), hex.EncodeToString(buf)),
+		UID:        uid,
+		Status:     orderStatusPaid,
+		CreateTime: now.Unix(),
+		UpdateTime: now.Unix(),
+	}
+
+	shopMu.Lock()
+	var remaining []cartItem
+	for _, c := range shop.Carts[uid] {
+		item := findGoods(goods, c.GoodsID)
+		if item == nil || (len(selected) > 0 && !selected[c.GoodsID]) {
+			remaining = append(remaining, c)
+			continue
+		}
+		price := goodsPrice(item)
+		cover := item["cover"]
+		if cover == nil {
+			cover = item["imgs"]
+		}
+		o.Items = append(o.Items, orderItem{
+			GoodsID: c.GoodsID,
+			Name:    goodsName(item),
+			Cover:   cover,
+			Price:   price,
+			Count:   c.Count,
+		})
+		o.TotalPrice += price * float64(c.Count)
+	}
+	if len(o.Items) == 0 {
+		shopMu.Unlock()
+		finalResp := map[string]interface{}{
+			"code": 400,
+			"msg":  "Cart is empty",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+	shop.Carts[uid] = remaining
+	shop.Orders = append(shop.Orders, o)
+	saveShopState()
+	shopMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": o,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func shopOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	pageNo := 0
+	pageSize := 10
+	if p := r.URL.Query().Get("pageNo"); p != "" {
+		fmt.Sscanf(p, "%d", &pageNo)
+	}
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		fmt.Sscanf(ps, "%d", &pageSize)
+	}
+	offset := pageNo * pageSize
+
+	shopMu.Lock()
+	if advanceOrders(time.Now()) {
+		saveShopState()
+	}
+	// Newest orders first
+	var orders []order
+	for i := len(shop.Orders) - 1; i >= 0; i-- {
+		if shop.Orders[i].UID == uid {
+			orders = append(orders, *shop.Orders[i])
+		}
+	}
+	shopMu.Unlock()
+
+	total := len(orders)
+	var list interface{}
+	end := offset + pageSize
+	if offset >= total {
+		list = []interface{}{}
+	} else {
+		if end > total {
+			end = total
+		}
+		list = orders[offset:end]
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"pageNo": pageNo,
+			"total":  total,
+			"list":   list,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+func shopOrderCancelHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shopMu.Lock()
+	advanceOrders(time.Now())
+	var target *order
+	for _, o := range shop.Orders {
+		if o.OrderID == req.OrderID && o.UID == uid {
+			target = o
+			break
+		}
+	}
+	code, msg := 200, ""
+	switch {
+	case target == nil:
+		code, msg = 404, "Order not found"
+	case target.Status != orderStatusPaid:
+		// Only orders that have not shipped yet can be cancelled
+		code, msg = 400, "Order can no longer be cancelled"
+	default:
+		target.Status = orderStatusCancelled
+		target.UpdateTime = time.Now().Unix()
+	}
+	saveShopState()
+	shopMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": code,
+		"msg":  msg,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
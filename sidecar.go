@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sidecarCache keeps the parsed form of files read during media scans. Since
+// the media directory is scanned on every request, a file is only parsed
+// again when its mtime or size changes.
+type sidecarCache struct {
+	mu      sync.Mutex
+	entries map[string]sidecarEntry
+}
+
+type sidecarEntry struct {
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+// load returns the cached value for path, calling parse when the file is new
+// or has changed. It returns nil when the file is missing or parse fails;
+// failures are cached too, so a broken file is not parsed on every scan.
+func (c *sidecarCache) load(path string, parse func(path string) (interface{}, error)) interface{} {
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return nil
+	}
+
+	c.mu.Lock()
+	cached, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.value
+	}
+
+	value, err := parse(path)
+	if err != nil {
+		value = nil
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]sidecarEntry)
+	}
+	c.entries[path] = sidecarEntry{modTime: stat.ModTime(), size: stat.Size(), value: value}
+	c.mu.Unlock()
+	return value
+}
+
+// fileVersion identifies the current contents of a file by size and mtime,
+// for naming files derived from it.
+func fileVersion(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x", stat.Size(), stat.ModTime().UnixNano()), nil
+}
+
+// fileQueue runs background work on media files one at a time. A file is
+// queued once until its work is done; files whose work failed are not
+// queued again until the server restarts.
+type fileQueue struct {
+	ch      chan string
+	mu      sync.Mutex
+	pending map[string]bool
+	failed  map[string]bool
+}
+
+func newFileQueue() *fileQueue {
+	return &fileQueue{
+		ch:      make(chan string, 64),
+		pending: make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+}
+
+// start runs work for each queued key in the background.
+func (q *fileQueue) start(name string, work func(key string) error) {
+	go func() {
+		for key := range q.ch {
+			err := work(key)
+			if err != nil {
+				log.Printf("%s %s failed: %v", name, key, err)
+			}
+			q.mu.Lock()
+			delete(q.pending, key)
+			if err != nil {
+				q.failed[key] = true
+			}
+			q.mu.Unlock()
+		}
+	}()
+}
+
+// add queues key unless it is already queued or failed before. When the
+// queue is full the key is dropped; the next scan adds it again.
+func (q *fileQueue) add(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[key] || q.failed[key] {
+		return
+	}
+	select {
+	case q.ch <- key:
+		q.pending[key] = true
+	default:
+	}
+}
+
+// dirVideoCounts caches, per directory and mtime, how many videos it holds.
+var (
+	dirVideoCounts   = make(map[string]dirVideoCount)
+	dirVideoCountsMu sync.Mutex
+)
+
+type dirVideoCount struct {
+	modTime time.Time
+	count   int
+}
+
+// onlyVideoInDir reports whether videoPath is the only video in its folder.
+// Folder-wide sidecars such as danmaku.xml are only used then, since they
+// cannot say which of several videos they belong to.
+func onlyVideoInDir(videoPath string) bool {
+	dir := filepath.Dir(videoPath)
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	dirVideoCountsMu.Lock()
+	cached, ok := dirVideoCounts[dir]
+	dirVideoCountsMu.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.count == 1
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() && isVideoFile(e.Name()) {
+			count++
+		}
+	}
+	dirVideoCountsMu.Lock()
+	dirVideoCounts[dir] = dirVideoCount{modTime: stat.ModTime(), count: count}
+	dirVideoCountsMu.Unlock()
+	return count == 1
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Likes and follows made on this instance, persisted as state/social.json.
+
+type likeRecord struct {
+	UID        string `json:"uid"`
+	AwemeID    string `json:"aweme_id"`
+	CreateTime int64  `json:"create_time"`
+}
+
+type followRecord struct {
+	UID        string `json:"uid"`
+	FollowUID  string `json:"follow_uid"`
+	CreateTime int64  `json:"create_time"`
+}
+
+type socialState struct {
+	Likes   []likeRecord   `json:"likes"`
+	Follows []followRecord `json:"follows"`
+}
+
+var social socialState
+var socialMu sync.Mutex
+
+func loadSocialState() {
+	socialMu.Lock()
+	defer socialMu.Unlock()
+	if err := loadState("social", &social); err != nil {
+		log.Printf("Failed to load social state: %v", err)
+	}
+}
+
+// saveSocialState must be called with socialMu held.
+func saveSocialState() {
+	if err := saveState("social", &social); err != nil {
+		log.Printf("Failed to save social state: %v", err)
+	}
+}
+
+// videoOwner returns the uid of the author of a video, if any.
+func videoOwner(video map[string]interface{}) string {
+	if video == nil {
+		return ""
+	}
+	if author, ok := video["author"].(map[string]interface{}); ok {
+		return idString(author["uid"])
+	}
+	return ""
+}
+
+// applyInteractionCounts adds likes and comments made on this instance to
+// the statistics of local videos.
+func applyInteractionCounts(videos []map[string]interface{}) {
+	likes := make(map[string]int)
+	socialMu.Lock()
+	for _, l := range social.Likes {
+		likes[l.AwemeID]++
+	}
+	socialMu.Unlock()
+	comments := commentCounts()
+
+	for _, v := range videos {
+		id, _ := v["aweme_id"].(string)
+		stats, ok := v["statistics"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		stats["digg_count"] = toInt(stats["digg_count"]) + likes[id]
+		stats["comment_count"] = toInt(stats["comment_count"]) + comments[id]
+	}
+}
+
+// toInt converts a JSON-ish number to int.
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// videoDiggHandler likes ({"aweme_id": "...", "digg": true}) or unlikes a video.
+func videoDiggHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		AwemeID string `json:"aweme_id"`
+		Digg    bool   `json:"digg"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	video := findVideo(req.AwemeID)
+	if video == nil {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Video not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	socialMu.Lock()
+	found := -1
+	for i, l := range social.Likes {
+		if l.UID == uid && l.AwemeID == req.AwemeID {
+			found = i
+			break
+		}
+	}
+	added := false
+	if req.Digg && found < 0 {
+		social.Likes = append(social.Likes, likeRecord{UID: uid, AwemeID: req.AwemeID, CreateTime: time.Now().Unix()})
+		added = true
+	} else if !req.Digg && found >= 0 {
+		social.Likes = append(social.Likes[:found], social.Likes[found+1:]...)
+	}
+	saveSocialState()
+	socialMu.Unlock()
+
+	if added {
+		addNotice(notice{UID: videoOwner(video), Type: noticeLike, FromUID: uid, AwemeID: req.AwemeID})
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"is_digg": req.Digg,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// userFollowHandler follows ({"uid": "...", "follow": true}) or unfollows a user.
+func userFollowHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		UID    string `json:"uid"`
+		Follow bool   `json:"follow"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil || req.UID == "" || req.UID == uid {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	socialMu.Lock()
+	found := -1
+	for i, f := range social.Follows {
+		if f.UID == uid && f.FollowUID == req.UID {
+			found = i
+			break
+		}
+	}
+	added := false
+	if req.Follow && found < 0 {
+		social.Follows = append(social.Follows, followRecord{UID: uid, FollowUID: req.UID, CreateTime: time.Now().Unix()})
+		added = true
+	} else if !req.Follow && found >= 0 {
+		social.Follows = append(social.Follows[:found], social.Follows[found+1:]...)
+	}
+	saveSocialState()
+	socialMu.Unlock()
+
+	if added {
+		addNotice(notice{UID: req.UID, Type: noticeFollow, FromUID: uid})
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"is_follow": req.Follow,
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
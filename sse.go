@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseHub fans server-sent events out to the subscribers of a topic. Topics
+// are plain strings such as "notice:<uid>".
+type sseHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]bool
+}
+
+var events = &sseHub{subs: make(map[string]map[chan []byte]bool)}
+
+const sseHeartbeat = 30 * time.Second
+
+func (h *sseHub) subscribe(topic string) chan []byte {
+	ch := make(chan []byte, 16)
+	h.mu.Lock()
+	if h.subs[topic] == nil {
+		h.subs[topic] = make(map[chan []byte]bool)
+	}
+	h.subs[topic][ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *sseHub) unsubscribe(topic string, ch chan []byte) {
+	h.mu.Lock()
+	delete(h.subs[topic], ch)
+	if len(h.subs[topic]) == 0 {
+		delete(h.subs, topic)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends one event to every subscriber of topic. Slow subscribers
+// whose buffer is full miss the event rather than block the publisher.
+func (h *sseHub) publish(topic, event string, v interface{}) {
+	msg := sseEvent(event, v)
+	if msg == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[topic] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// serveSSE streams topic to the client until it disconnects. initial, when
+// not nil, is written first so the client starts from the current state.
+func serveSSE(w http.ResponseWriter, r *http.Request, topic string, initial []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := events.subscribe(topic)
+	defer events.unsubscribe(topic, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	if initial != nil {
+		w.Write(initial)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// sseEvent formats a single event for use as the initial payload of serveSSE.
+func sseEvent(event string, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+}
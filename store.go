@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// stateDir holds the JSON documents written by the server (carts, orders,
+// sessions, ...). Each feature owns one document named after it.
+var stateDir string
+
+// loadState reads stateDir/<name>.json into v. A missing file is not an error
+// and leaves v untouched.
+func loadState(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(stateDir, name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveState writes v to stateDir/<name>.json. The document is written to a
+// temporary file first so a crash never leaves a half-written state behind.
+func saveState(name string, v interface{}) error {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, name+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// The server keeps its state in memory and writes whole documents back, so
+// a subcommand editing stateDir while it runs would be overwritten. The
+// server holds stateDir/server.lock, with its pid, while it is running.
+const stateLockName = "server.lock"
+
+// lockStateDir creates the lock file and removes it when the server is
+// stopped with Ctrl-C or SIGTERM.
+func lockStateDir() {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		log.Printf("Failed to create state directory: %v", err)
+		return
+	}
+	path := filepath.Join(stateDir, stateLockName)
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		log.Printf("Failed to write %s: %v", path, err)
+		return
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		os.Remove(path)
+		os.Exit(0)
+	}()
+}
+
+// checkStateUnlocked refuses to let a subcommand touch stateDir while the
+// server holds it.
+func checkStateUnlocked() error {
+	path := filepath.Join(stateDir, stateLockName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return fmt.Errorf("the server (pid %s) is using %s; stop it first, or delete %s if it is no longer running",
+		strings.TrimSpace(string(data)), stateDir, path)
+}
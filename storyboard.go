@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Seek previews for long videos: frames taken every storyboardInterval
+// seconds are tiled into sprite sheets of storyboardColumns x storyboardRows
+// thumbnails, and a WebVTT storyboard maps each time range to its region:
+//
+//	00:00:10.000 --> 00:00:20.000
+//	sprite-1.jpg#xywh=160,0,160,90
+//
+// The sheets are made in the background by thumbnailerPath (ffmpeg) and kept
+// in cacheDir/storyboard. The storyboard itself is rendered on request.
+
+const (
+	storyboardColumns = 10
+	storyboardRows    = 10
+	// Thumbnails are this many pixels on their longer side
+	storyboardThumbSize = 160
+)
+
+var (
+	thumbnailerPath    string
+	storyboardInterval int
+)
+
+var storyboardQueue = newFileQueue()
+
+// storyboardLayout describes the sprite sheets of a video.
+type storyboardLayout struct {
+	duration      float64
+	width, height int
+	count         int // thumbnails
+}
+
+func (l storyboardLayout) sheets() int {
+	per := storyboardColumns * storyboardRows
+	return (l.count + per - 1) / per
+}
+
+// storyboardFor returns the layout of a video's storyboard, or false when it
+// cannot have one.
+func storyboardFor(path string) (storyboardLayout, bool) {
+	probe := probeMedia(path)
+	if probe == nil || probe.Duration <= 0 || probe.Width <= 0 || probe.Height <= 0 || storyboardInterval <= 0 {
+		return storyboardLayout{}, false
+	}
+	l := storyboardLayout{duration: probe.Duration}
+	// Even sizes, as most encoders require
+	scale := float64(storyboardThumbSize) / float64(max(probe.Width, probe.Height))
+	l.width = int(math.Round(float64(probe.Width)*scale/2)) * 2
+	l.height = int(math.Round(float64(probe.Height)*scale/2)) * 2
+	l.count = int(math.Ceil(probe.Duration / float64(storyboardInterval)))
+	return l, true
+}
+
+func storyboardDir(awemeID, path string) (string, error) {
+	version, err := fileVersion(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "storyboard", awemeID+"-"+version), nil
+}
+
+func startStoryboards() {
+	if thumbnailerPath == "" {
+		return
+	}
+	storyboardQueue.start("Storyboard", makeStoryboard)
+}
+
+// applyStoryboard advertises the storyboard of a long video once its sprite
+// sheets exist, and queues them otherwise.
+func applyStoryboard(video map[string]interface{}, awemeID, path string) {
+	if !isLongVideo(video) {
+		return
+	}
+	layout, ok := storyboardFor(path)
+	if !ok {
+		return
+	}
+	dir, err := storyboardDir(awemeID, path)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if thumbnailerPath != "" {
+			storyboardQueue.add(path)
+		}
+		return
+	}
+
+	sprites := make([]string, layout.sheets())
+	for i := range sprites {
+		sprites[i] = fmt.Sprintf("/storyboard/%s/sprite-%d.jpg", awemeID, i+1)
+	}
+	v, ok := video["video"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	v["storyboard"] = map[string]interface{}{
+		"url":         "/storyboard/" + awemeID + "/storyboard.vtt",
+		"sprite_urls": sprites,
+		"interval":    storyboardInterval,
+		"count":       layout.count,
+		"width":       layout.width,
+		"height":      layout.height,
+		"columns":     storyboardColumns,
+		"rows":        storyboardRows,
+	}
+}
+
+// makeStoryboard extracts the frames of a video into sprite sheets.
+func makeStoryboard(path string) error {
+	rel, err := filepath.Rel(mediaDir, path)
+	if err != nil {
+		return err
+	}
+	awemeID := mediaID(rel)
+	layout, ok := storyboardFor(path)
+	if !ok {
+		return fmt.Errorf("unknown duration or size")
+	}
+	dir, err := storyboardDir(awemeID, path)
+	if err != nil {
+		return err
+	}
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d",
+		storyboardInterval, layout.width, layout.height, storyboardColumns, storyboardRows)
+	cmd := exec.Command(thumbnailerPath,
+		"-hide_banner", "-nostdin", "-loglevel", "error",
+		"-i", path,
+		"-an", "-vf", filter,
+		"-q:v", "5",
+		filepath.Join(tmp, "sprite-%d.jpg"),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, dir)
+}
+
+// storyboardVTT renders the WebVTT storyboard of a layout. query is added to
+// the sprite URLs, so a ?token= for a private video reaches them too.
+func storyboardVTT(l storyboardLayout, query string) string {
+	if query != "" {
+		query = "?" + query
+	}
+	per := storyboardColumns * storyboardRows
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < l.count; i++ {
+		start := float64(i * storyboardInterval)
+		end := math.Min(start+float64(storyboardInterval), l.duration)
+		cell := i % per
+		fmt.Fprintf(&b, "\n%s --> %s\nsprite-%d.jpg%s#xywh=%d,%d,%d,%d\n",
+			vttTime(start), vttTime(end), i/per+1, query,
+			cell%storyboardColumns*l.width, cell/storyboardColumns*l.height, l.width, l.height)
+	}
+	return b.String()
+}
+
+func vttTime(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// storyboardHandler serves /storyboard/<aweme_id>/storyboard.vtt and the
+// sprite sheets it refers to.
+func storyboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	awemeID, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/storyboard/"), "/")
+	path, ok := localMediaPath(r, awemeID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	layout, ok := storyboardFor(path)
+	dir, err := storyboardDir(awemeID, path)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := os.Stat(dir); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name == "storyboard.vtt" {
+		var query string
+		if token := r.URL.Query().Get("token"); token != "" {
+			query = "token=" + url.QueryEscape(token)
+		}
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Write([]byte(storyboardVTT(layout, query)))
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "sprite-"), ".jpg"))
+	if err != nil || fmt.Sprintf("sprite-%d.jpg", n) != name {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background transcoding of local videos into H.264 renditions that every
+// browser plays. Each scanned video gets one job per rendition no larger than
+// the source; ffmpegPath runs them, transcodeWorkers at a time. Finished
+// renditions are written to cacheDir/renditions/<aweme_id>/<height>p.mp4 and
+// listed in the video's bit_rate array. Jobs are persisted as
+// state/transcode.json, so the queue survives restarts.
+
+var (
+	ffmpegPath       string
+	transcodeWorkers int
+	transcodeRetries int
+	renditionHeights = []int{1080, 720, 540}
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+type transcodeJob struct {
+	ID      string `json:"id"`
+	AwemeID string `json:"aweme_id"`
+	Source  string `json:"source"`
+	// Version of the source file the job was made for, see fileVersion.
+	SourceVersion string  `json:"source_version"`
+	Height        int     `json:"height"`
+	Status        string  `json:"status"`
+	Progress      float64 `json:"progress"`
+	Attempts      int     `json:"attempts"`
+	Error         string  `json:"error,omitempty"`
+	CreateTime    int64   `json:"create_time"`
+	UpdateTime    int64   `json:"update_time"`
+	// Output, set when the job is done
+	OutWidth  int   `json:"out_width,omitempty"`
+	OutHeight int   `json:"out_height,omitempty"`
+	OutSize   int64 `json:"out_size,omitempty"`
+	BitRate   int   `json:"bit_rate,omitempty"`
+}
+
+var transcodeJobs = make(map[string]*transcodeJob)
+var transcodeMu sync.Mutex
+var transcodeCond = sync.NewCond(&transcodeMu)
+
+func loadTranscodeState() {
+	transcodeMu.Lock()
+	defer transcodeMu.Unlock()
+	if err := loadState("transcode", &transcodeJobs); err != nil {
+		log.Printf("Failed to load transcode jobs: %v", err)
+	}
+	if transcodeJobs == nil {
+		transcodeJobs = make(map[string]*transcodeJob)
+	}
+	// Jobs interrupted by a restart start over
+	for _, job := range transcodeJobs {
+		if job.Status == jobRunning {
+			job.Status = jobQueued
+			job.Progress = 0
+		}
+	}
+}
+
+// saveTranscodeState must be called with transcodeMu held.
+func saveTranscodeState() {
+	if err := saveState("transcode", transcodeJobs); err != nil {
+		log.Printf("Failed to save transcode jobs: %v", err)
+	}
+}
+
+// startTranscoder starts the workers when an encoder is configured.
+func startTranscoder() {
+	if ffmpegPath == "" {
+		return
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		log.Printf("Transcoding disabled: %v", err)
+		ffmpegPath = ""
+		return
+	}
+	for i := 0; i < transcodeWorkers; i++ {
+		go transcodeWorker()
+	}
+	log.Printf("Transcoding with %s, %d worker(s)", ffmpegPath, transcodeWorkers)
+}
+
+func renditionPath(awemeID string, height int) string {
+	return filepath.Join(cacheDir, "renditions", awemeID, fmt.Sprintf("%dp.mp4", height))
+}
+
+func renditionURL(awemeID string, height int) string {
+	return fmt.Sprintf("/rendition/%s/%dp.mp4", awemeID, height)
+}
+
+// renditionTargets picks the renditions made for a source: those no larger
+// than its shorter side, or only the smallest one for small or unknown
+// sources so they still get a playable copy.
+func renditionTargets(path string) []int {
+	var targets []int
+	if probe := probeMedia(path); probe != nil && probe.Width > 0 && probe.Height > 0 {
+		short := min(probe.Width, probe.Height)
+		for _, h := range renditionHeights {
+			if h <= short {
+				targets = append(targets, h)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		targets = []int{renditionHeights[len(renditionHeights)-1]}
+	}
+	return targets
+}
+
+// applyRenditions lists the finished renditions of a scanned video in its
+// bit_rate array, and queues the missing ones.
+func applyRenditions(video map[string]interface{}, awemeID, path string) {
+	version, err := fileVersion(path)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+
+	var done []*transcodeJob
+	transcodeMu.Lock()
+	queued := false
+	for _, h := range renditionTargets(path) {
+		id := fmt.Sprintf("%s-%dp", awemeID, h)
+		job := transcodeJobs[id]
+		if job != nil && job.SourceVersion == version && job.Source == path {
+			if job.Status != jobDone {
+				continue
+			}
+			if _, err := os.Stat(renditionPath(awemeID, h)); err == nil {
+				done = append(done, job)
+				continue
+			}
+			// The cache was cleared: make it again
+		}
+		if ffmpegPath == "" {
+			continue
+		}
+		transcodeJobs[id] = &transcodeJob{
+			ID:            id,
+			AwemeID:       awemeID,
+			Source:        path,
+			SourceVersion: version,
+			Height:        h,
+			Status:        jobQueued,
+			CreateTime:    now,
+			UpdateTime:    now,
+		}
+		queued = true
+	}
+	if queued {
+		saveTranscodeState()
+		transcodeCond.Broadcast()
+	}
+	transcodeMu.Unlock()
+
+	if len(done) == 0 {
+		return
+	}
+	v, ok := video["video"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	bitRates := make([]map[string]interface{}, 0, len(done))
+	for _, job := range done {
+		url := renditionURL(awemeID, job.Height)
+		bitRates = append(bitRates, map[string]interface{}{
+			"gear_name":    fmt.Sprintf("normal_%d_0", job.Height),
+			"quality_type": renditionQuality(job.Height),
+			"bit_rate":     job.BitRate,
+			"is_h265":      0,
+			"is_bytevc1":   0,
+			"play_addr": map[string]interface{}{
+				"uri":       fmt.Sprintf("%s_%dp", awemeID, job.Height),
+				"url_list":  []string{url},
+				"width":     job.OutWidth,
+				"height":    job.OutHeight,
+				"data_size": job.OutSize,
+			},
+		})
+	}
+	// Highest quality first, as Douyin lists them
+	sort.Slice(bitRates, func(i, j int) bool {
+		return toInt(bitRates[i]["quality_type"]) < toInt(bitRates[j]["quality_type"])
+	})
+	v["bit_rate"] = bitRates
+}
+
+// renditionQuality maps a rendition to Douyin's quality_type, lower is
+// better.
+func renditionQuality(height int) int {
+	switch {
+	case height >= 1080:
+		return 1
+	case height >= 720:
+		return 10
+	default:
+		return 20
+	}
+}
+
+// nextTranscodeJob returns the oldest queued job, smaller renditions first so
+// a playable copy is ready early. It must be called with transcodeMu held.
+func nextTranscodeJob() *transcodeJob {
+	var next *transcodeJob
+	for _, job := range transcodeJobs {
+		if job.Status != jobQueued {
+			continue
+		}
+		if next == nil || job.CreateTime < next.CreateTime ||
+			job.CreateTime == next.CreateTime && (job.Height < next.Height || job.Height == next.Height && job.ID < next.ID) {
+			next = job
+		}
+	}
+	return next
+}
+
+func transcodeWorker() {
+	for {
+		transcodeMu.Lock()
+		job := nextTranscodeJob()
+		for job == nil {
+			transcodeCond.Wait()
+			job = nextTranscodeJob()
+		}
+		job.Status = jobRunning
+		job.Progress = 0
+		job.Attempts++
+		job.UpdateTime = time.Now().Unix()
+		saveTranscodeState()
+		source, version, awemeID, height := job.Source, job.SourceVersion, job.AwemeID, job.Height
+		transcodeMu.Unlock()
+
+		err := runTranscode(job.ID, source, version, awemeID, height)
+
+		transcodeMu.Lock()
+		// The job may have been replaced while running, e.g. when the source
+		// changed
+		if transcodeJobs[job.ID] == job {
+			job.UpdateTime = time.Now().Unix()
+			if err == nil {
+				job.Status = jobDone
+				job.Progress = 1
+				job.Error = ""
+				out := renditionPath(awemeID, height)
+				if probe := probeMedia(out); probe != nil {
+					job.OutWidth, job.OutHeight = probe.Width, probe.Height
+					if info, err := os.Stat(out); err == nil {
+						job.OutSize = info.Size()
+						if probe.Duration > 0 {
+							job.BitRate = int(float64(info.Size()*8) / probe.Duration)
+						}
+					}
+				}
+			} else {
+				job.Error = err.Error()
+				if job.Attempts <= transcodeRetries {
+					job.Status = jobQueued
+				} else {
+					job.Status = jobFailed
+				}
+				log.Printf("Transcode %s failed (attempt %d): %v", job.ID, job.Attempts, err)
+			}
+			saveTranscodeState()
+		}
+		transcodeMu.Unlock()
+	}
+}
+
+// runTranscode encodes source into the rendition of the given height,
+// updating the job's progress from ffmpeg's -progress output.
+func runTranscode(jobID, source, version, awemeID string, height int) error {
+	if v, err := fileVersion(source); err != nil || v != version {
+		return errors.New("source file changed or missing")
+	}
+	dest := renditionPath(awemeID, height)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp.mp4"
+	defer os.Remove(tmp)
+
+	// Scale the shorter side to height, never upscaling
+	scale := fmt.Sprintf("scale=-2:'min(%d,ih)'", height)
+	var duration float64
+	if probe := probeMedia(source); probe != nil {
+		duration = probe.Duration
+		if probe.Height > probe.Width {
+			scale = fmt.Sprintf("scale='min(%d,iw)':-2", height)
+		}
+	}
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner", "-nostdin", "-nostats", "-y",
+		"-i", source,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", scale,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23",
+		"-profile:v", "high", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k",
+		"-movflags", "+faststart",
+		"-progress", "pipe:1",
+		tmp,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		// out_time_us is in microseconds (and so, despite its name, is
+		// out_time_ms)
+		value, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok || duration <= 0 {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		progress := min(float64(us)/1e6/duration, 0.99)
+		transcodeMu.Lock()
+		if job := transcodeJobs[jobID]; job != nil && job.Status == jobRunning && progress > job.Progress {
+			job.Progress = progress
+		}
+		transcodeMu.Unlock()
+	}
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return os.Rename(tmp, dest)
+}
+
+// transcodeJobsHandler lists the jobs of the current user's videos, newest
+// first. ?status= and ?aweme_id= filter the list.
+func transcodeJobsHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	pageNo := 0
+	pageSize := 20
+	fmt.Sscanf(r.URL.Query().Get("pageNo"), "%d", &pageNo)
+	fmt.Sscanf(r.URL.Query().Get("pageSize"), "%d", &pageSize)
+	status := r.URL.Query().Get("status")
+	awemeID := r.URL.Query().Get("aweme_id")
+
+	transcodeMu.Lock()
+	var jobs []transcodeJob
+	for _, job := range transcodeJobs {
+		if (status == "" || job.Status == status) && (awemeID == "" || job.AwemeID == awemeID) {
+			jobs = append(jobs, *job)
+		}
+	}
+	transcodeMu.Unlock()
+
+	list := make([]transcodeJob, 0, len(jobs))
+	for _, job := range jobs {
+		if mediaOwner(job.AwemeID, job.Source) == uid {
+			list = append(list, job)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].UpdateTime != list[j].UpdateTime {
+			return list[i].UpdateTime > list[j].UpdateTime
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	total := len(list)
+	offset := pageNo * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + pageSize
+	if end > total {
+		end = total
+	}
+	if end < offset {
+		end = offset
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"pageNo":  pageNo,
+			"total":   total,
+			"list":    list[offset:end],
+			"enabled": ffmpegPath != "",
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// transcodeRetryHandler queues a failed job again ({"id": "..."}).
+func transcodeRetryHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		writeUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := decodeJSONBody(r, &req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	transcodeMu.Lock()
+	job := transcodeJobs[req.ID]
+	var awemeID, source string
+	if job != nil {
+		awemeID, source = job.AwemeID, job.Source
+	}
+	transcodeMu.Unlock()
+	if job == nil || mediaOwner(awemeID, source) != uid {
+		finalResp := map[string]interface{}{
+			"code": 404,
+			"msg":  "Job not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	transcodeMu.Lock()
+	if job.Status == jobFailed {
+		job.Status = jobQueued
+		job.Attempts = 0
+		job.Progress = 0
+		job.Error = ""
+		job.UpdateTime = time.Now().Unix()
+		saveTranscodeState()
+		transcodeCond.Broadcast()
+	}
+	snapshot := *job
+	transcodeMu.Unlock()
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": snapshot,
+		"msg":  "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
+
+// renditionHandler serves finished renditions, with the same access rules
+// as the source video.
+func renditionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	awemeID, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/rendition/"), "/")
+	height, err := strconv.Atoi(strings.TrimSuffix(name, "p.mp4"))
+	if err != nil || fmt.Sprintf("%dp.mp4", height) != name {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := localMediaPath(r, awemeID); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	path := renditionPath(awemeID, height)
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (core, creation and
+// termination), so stock clients such as tus-js-client work:
+//
+//	POST   /upload/       Upload-Length, Upload-Metadata -> 201 Location
+//	HEAD   /upload/<id>   -> Upload-Offset
+//	PATCH  /upload/<id>   Upload-Offset + bytes -> 204 Upload-Offset
+//	DELETE /upload/<id>   abort
+//
+// Partial files are kept in stateDir/uploads. Once the last byte arrives the
+// file is checked, moved to media/<uid>/ (or the private folder) and its
+// metadata recorded in the catalog, so it shows up on the next scan.
+
+const tusVersion = "1.0.0"
+
+var uploadMaxSize int64
+
+type upload struct {
+	ID         string   `json:"id"`
+	UID        string   `json:"uid"`
+	Length     int64    `json:"length"`
+	Filename   string   `json:"filename"`
+	Desc       string   `json:"desc,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Music      string   `json:"music,omitempty"`
+	Visibility string   `json:"visibility"`
+	CreateTime int64    `json:"create_time"`
+	// AwemeID is set once the upload is complete.
+	AwemeID string `json:"aweme_id,omitempty"`
+}
+
+var uploads = make(map[string]*upload)
+var uploadsMu sync.Mutex
+
+// uploadsBusy marks uploads a PATCH is currently writing to or finishing.
+var uploadsBusy = make(map[string]bool)
+
+// uploadsMoving holds the destinations of uploads being moved into place,
+// so two uploads finishing at once cannot pick the same file name.
+var uploadsMoving = make(map[string]bool)
+
+func loadUploadState() {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	if err := loadState("uploads", &uploads); err != nil {
+		log.Printf("Failed to load uploads: %v", err)
+	}
+	if uploads == nil {
+		uploads = make(map[string]*upload)
+	}
+}
+
+// saveUploadState must be called with uploadsMu held.
+func saveUploadState() {
+	if err := saveState("uploads", uploads); err != nil {
+		log.Printf("Failed to save uploads: %v", err)
+	}
+}
+
+// Finished uploads are kept for a day so clients can look up the resulting
+// video; unfinished ones are dropped after a week.
+const (
+	uploadKeepDone    = 24 * time.Hour
+	uploadKeepPartial = 7 * 24 * time.Hour
+)
+
+// pruneUploads must be called with uploadsMu held.
+func pruneUploads(now time.Time) {
+	for id, u := range uploads {
+		age := now.Sub(time.Unix(u.CreateTime, 0))
+		if uploadsBusy[id] || (u.AwemeID != "" && age < uploadKeepDone) || (u.AwemeID == "" && age < uploadKeepPartial) {
+			continue
+		}
+		delete(uploads, id)
+		os.Remove(uploadPartPath(id))
+	}
+}
+
+func uploadPartPath(id string) string {
+	return filepath.Join(stateDir, "uploads", id+".part")
+}
+
+// uploadOffset is the number of bytes received so far.
+func uploadOffset(u *upload) int64 {
+	if u.AwemeID != "" {
+		return u.Length
+	}
+	info, err := os.Stat(uploadPartPath(u.ID))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2".
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata %q", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// splitTags accepts "a, #b c" style tag lists.
+func splitTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '，'
+	}) {
+		if tag = strings.TrimPrefix(tag, "#"); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// checkUploadedVideo makes sure a finished upload really is a video of the
+// type its name claims.
+func checkUploadedVideo(path, ext string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return errors.New("file is too short")
+	}
+	format := mediaFormatFor(ext)
+	if format == nil {
+		return errors.New("unsupported file type")
+	}
+	switch format.Container {
+	case "mp4":
+		if string(head[4:8]) != "ftyp" && !format.NoFtyp {
+			return errors.New("not an MP4 file")
+		}
+		_, err = probeMP4(f, stat.Size())
+	case "webm":
+		_, err = probeWebM(f, stat.Size())
+	case "ogg":
+		if !bytes.HasPrefix(head, []byte("OggS")) {
+			return errors.New("not an Ogg file")
+		}
+	}
+	return err
+}
+
+// uploadDestination picks a free file name in the user's folder. It must be
+// called with uploadsMu held.
+func uploadDestination(u *upload) (string, error) {
+	dir := filepath.Join(mediaDir, u.UID)
+	if u.Visibility == "private" {
+		dir = filepath.Join(privateRoot(), u.UID)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(u.Filename))
+	base := strings.TrimLeft(strings.TrimSuffix(filepath.Base(u.Filename), filepath.Ext(u.Filename)), ".")
+	if base == "" {
+		base = u.ID
+	}
+	for i := 0; ; i++ {
+		name := base + ext
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) && !uploadsMoving[path] {
+			return path, nil
+		}
+	}
+}
+
+// moveFile renames src to dst, copying when they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// finishUpload moves a complete upload into the media directory, records
+// its owner and metadata and returns its aweme_id. It runs without uploadsMu,
+// since checking and copying a large file takes a while; uploadsBusy keeps
+// other requests off the upload meanwhile.
+func finishUpload(u *upload) (string, error) {
+	part := uploadPartPath(u.ID)
+	if err := checkUploadedVideo(part, strings.ToLower(filepath.Ext(u.Filename))); err != nil {
+		return "", err
+	}
+	uploadsMu.Lock()
+	dest, err := uploadDestination(u)
+	if err == nil {
+		uploadsMoving[dest] = true
+	}
+	uploadsMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		uploadsMu.Lock()
+		delete(uploadsMoving, dest)
+		uploadsMu.Unlock()
+	}()
+	if err := moveFile(part, dest); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(mediaDir, dest)
+	if err != nil {
+		return "", err
+	}
+	id := mediaID(rel)
+	rememberMediaPath(id, dest)
+
+	catalogMu.Lock()
+	catalog[id] = &catalogRecord{
+		Owner:      u.UID,
+		Desc:       u.Desc,
+		Tags:       u.Tags,
+		Music:      u.Music,
+		CreateTime: time.Now().Unix(),
+	}
+	saveCatalogState()
+	catalogMu.Unlock()
+
+	log.Printf("Upload %s by %s saved as %s", u.ID, u.UID, dest)
+	return id, nil
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, X-HTTP-Method-Override")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, X-Aweme-Id")
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadMaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+	if method != "GET" && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	uid := requestUID(r)
+	if uid == "" {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if id == "" {
+		if method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r, uid)
+		return
+	}
+
+	uploadsMu.Lock()
+	u := uploads[id]
+	var awemeID string
+	if u != nil {
+		awemeID = u.AwemeID
+	}
+	uploadsMu.Unlock()
+	if u == nil || u.UID != uid {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch method {
+	case "HEAD":
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(uploadOffset(u), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		if awemeID != "" {
+			w.Header().Set("X-Aweme-Id", awemeID)
+		}
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		patchUpload(w, r, u)
+	case "DELETE":
+		uploadsMu.Lock()
+		if uploadsBusy[id] {
+			uploadsMu.Unlock()
+			http.Error(w, "Upload is in progress", http.StatusConflict)
+			return
+		}
+		delete(uploads, id)
+		saveUploadState()
+		uploadsMu.Unlock()
+		os.Remove(uploadPartPath(id))
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		data := map[string]interface{}{
+			"id":       u.ID,
+			"offset":   uploadOffset(u),
+			"length":   u.Length,
+			"aweme_id": awemeID,
+		}
+		if awemeID != "" && u.Visibility != "private" {
+			data["video"] = findVideo(awemeID)
+		}
+		finalResp := map[string]interface{}{
+			"code": 200,
+			"data": data,
+			"msg":  "",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createUpload handles POST /upload/. Metadata keys: filename (required),
+// filetype, desc, tags, music and visibility (public or private).
+func createUpload(w http.ResponseWriter, r *http.Request, uid string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > uploadMaxSize {
+		http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := filepath.Base(strings.ReplaceAll(meta["filename"], `\`, "/"))
+	if !hasExt(filename, uploadFormats()) {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if t := meta["filetype"]; t != "" && !strings.HasPrefix(t, "video/") && !strings.HasPrefix(t, "audio/ogg") {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	visibility := meta["visibility"]
+	switch visibility {
+	case "", "public":
+		visibility = "public"
+	case "private":
+		if privateRoot() == "" {
+			http.Error(w, "Private videos are disabled", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	u := &upload{
+		ID:         hex.EncodeToString(buf),
+		UID:        uid,
+		Length:     length,
+		Filename:   filename,
+		Desc:       strings.TrimSpace(meta["desc"]),
+		Tags:       splitTags(meta["tags"]),
+		Music:      strings.TrimSpace(meta["music"]),
+		Visibility: visibility,
+		CreateTime: time.Now().Unix(),
+	}
+	if err := os.MkdirAll(filepath.Dir(uploadPartPath(u.ID)), 0o755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(uploadPartPath(u.ID), nil, 0o644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uploadsMu.Lock()
+	pruneUploads(time.Now())
+	uploads[u.ID] = u
+	saveUploadState()
+	uploadsMu.Unlock()
+
+	w.Header().Set("Location", "/upload/"+u.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchUpload appends a chunk at Upload-Offset. An interrupted request keeps
+// whatever arrived, and the client resumes from the offset HEAD reports.
+func patchUpload(w http.ResponseWriter, r *http.Request, u *upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	uploadsMu.Lock()
+	if uploadsBusy[u.ID] {
+		uploadsMu.Unlock()
+		http.Error(w, "Upload is in progress", http.StatusConflict)
+		return
+	}
+	uploadsBusy[u.ID] = true
+	uploadsMu.Unlock()
+	defer func() {
+		uploadsMu.Lock()
+		delete(uploadsBusy, u.ID)
+		uploadsMu.Unlock()
+	}()
+
+	offset := uploadOffset(u)
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) || u.AwemeID != "" {
+		http.Error(w, "Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(uploadPartPath(u.ID), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+	f.Close()
+	offset += written
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at %d: %v", u.ID, offset, copyErr)
+		return
+	}
+
+	if offset == u.Length {
+		id, err := finishUpload(u)
+		uploadsMu.Lock()
+		if err != nil {
+			delete(uploads, u.ID)
+		} else {
+			u.AwemeID = id
+		}
+		saveUploadState()
+		uploadsMu.Unlock()
+		if err != nil {
+			os.Remove(uploadPartPath(u.ID))
+			http.Error(w, "Invalid video: "+err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("X-Aweme-Id", id)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
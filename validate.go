@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Validation of the media files the scanner finds. Files whose container is
+// broken (a truncated upload, an interrupted copy) are quarantined: they are
+// left out of every feed and listed by /admin/media/problems with the reason,
+// until they change on disk and pass again.
+//
+// MP4/MOV files need a complete moov with a non-zero duration and sample
+// tables pointing inside the file; WebM/Matroska files an EBML header and a
+// Segment with Tracks and a first Cluster; Ogg files the OggS capture
+// pattern. Other formats only need to be non-empty.
+
+var problemCache sidecarCache
+
+// mediaProblem returns why a video file cannot be played, or "" when it
+// looks fine. The result is cached until the file changes.
+func mediaProblem(path string) string {
+	problem, _ := problemCache.load(path, func(path string) (interface{}, error) {
+		problem := checkMediaFile(path)
+		if problem != "" {
+			log.Printf("Quarantined %s: %s", path, problem)
+		}
+		return problem, nil
+	}).(string)
+	return problem
+}
+
+func checkMediaFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err.Error()
+	}
+	if stat.Size() == 0 {
+		return "empty file"
+	}
+	format := mediaFormatFor(path)
+	if format == nil {
+		return ""
+	}
+	switch format.Container {
+	case "mp4":
+		return checkMP4(f, stat.Size())
+	case "webm":
+		return checkWebM(f, stat.Size())
+	case "ogg":
+		magic := make([]byte, 4)
+		if _, err := f.ReadAt(magic, 0); err != nil || string(magic) != "OggS" {
+			return "missing Ogg header"
+		}
+	}
+	return ""
+}
+
+func checkMP4(r io.ReaderAt, size int64) string {
+	top, err := readMP4Boxes(r, 0, size)
+	if err != nil {
+		// Usually a truncated mdat
+		return fmt.Sprintf("truncated or corrupt: %v", err)
+	}
+	moov, ok := findMP4Box(top, "moov")
+	if !ok {
+		return "no moov box"
+	}
+	children, err := mp4Children(r, moov)
+	if err != nil {
+		return fmt.Sprintf("corrupt moov: %v", err)
+	}
+	// Fragmented files keep their samples in moof boxes
+	_, fragmented := findMP4Box(children, "mvex")
+	if fragmented {
+		if _, ok := findMP4Box(top, "moof"); !ok {
+			return "fragmented file without fragments"
+		}
+		return ""
+	}
+
+	mvhd, ok := findMP4Box(children, "mvhd")
+	if !ok {
+		return "no mvhd box"
+	}
+	data, err := readMP4BoxData(r, mvhd, 1024)
+	if err != nil {
+		return fmt.Sprintf("corrupt mvhd: %v", err)
+	}
+	if parseMvhdDuration(data) <= 0 {
+		return "zero duration"
+	}
+
+	media := 0
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		t, err := readMP4Track(r, trak)
+		if err != nil {
+			return fmt.Sprintf("track %d: %v", mp4TrackID(r, trak), err)
+		}
+		if t.handler != "vide" && t.handler != "soun" {
+			continue
+		}
+		if len(t.samples) == 0 {
+			return fmt.Sprintf("track %d has no samples", t.id)
+		}
+		for _, s := range t.samples {
+			if s.offset < 0 || s.offset+int64(s.size) > size {
+				return fmt.Sprintf("track %d: samples point past the end of the file", t.id)
+			}
+		}
+		media++
+	}
+	if media == 0 {
+		return "no video or audio track"
+	}
+	return ""
+}
+
+func checkWebM(r io.ReaderAt, size int64) string {
+	top, err := readEBMLElements(r, 0, size)
+	if len(top) == 0 || top[0].id != ebmlHeaderID {
+		return "missing EBML header"
+	}
+	if err != nil {
+		return fmt.Sprintf("truncated or corrupt: %v", err)
+	}
+	var segment *ebmlElement
+	for i := range top {
+		if top[i].id == mkvSegment {
+			segment = &top[i]
+			break
+		}
+	}
+	if segment == nil {
+		return "no Segment element"
+	}
+	children, err := readEBMLElements(r, segment.offset, segment.offset+segment.size)
+	if err != nil {
+		return fmt.Sprintf("truncated or corrupt: %v", err)
+	}
+	// Recordings made in browsers often have no Duration, so it is not
+	// required here
+	var tracks, cluster bool
+	for _, e := range children {
+		switch e.id {
+		case mkvTracks:
+			tracks = true
+		case mkvCluster:
+			cluster = true
+		}
+	}
+	if !tracks {
+		return "no Tracks element"
+	}
+	if !cluster {
+		return "no media data"
+	}
+	return ""
+}
+
+// mediaProblemEntry is one line of the /admin/media/problems report.
+type mediaProblemEntry struct {
+	AwemeID string `json:"aweme_id"`
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+}
+
+// findMediaProblems validates every video under mediaDir, private folders
+// included.
+func findMediaProblems() ([]mediaProblemEntry, error) {
+	var problems []mediaProblemEntry
+	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == mediaDir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isVideoFile(d.Name()) {
+			return nil
+		}
+		reason := mediaProblem(path)
+		if reason == "" {
+			return nil
+		}
+		relPath, err := filepath.Rel(mediaDir, path)
+		if err != nil {
+			return nil
+		}
+		entry := mediaProblemEntry{
+			AwemeID: mediaID(relPath),
+			Path:    filepath.ToSlash(relPath),
+			Reason:  reason,
+		}
+		if info, err := d.Info(); err == nil {
+			entry.Size = info.Size()
+			entry.ModTime = info.ModTime().Unix()
+		}
+		problems = append(problems, entry)
+		return nil
+	})
+	return problems, err
+}
+
+// requestAdmin reports whether the request comes from an administrator. In
+// single-user mode the local user is one.
+func requestAdmin(r *http.Request) bool {
+	if len(accounts) == 0 {
+		return true
+	}
+	a := requestUser(r)
+	return a != nil && a.Admin
+}
+
+// mediaProblemsHandler serves /admin/media/problems, the quarantined files,
+// most recently changed first.
+func mediaProblemsHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if requestUID(r) == "" {
+		writeUnauthorized(w)
+		return
+	}
+	if !requestAdmin(r) {
+		finalResp := map[string]interface{}{
+			"code": 403,
+			"msg":  "Admin only",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(finalResp)
+		return
+	}
+
+	pageNo := 0
+	pageSize := 20
+	fmt.Sscanf(r.URL.Query().Get("pageNo"), "%d", &pageNo)
+	fmt.Sscanf(r.URL.Query().Get("pageSize"), "%d", &pageSize)
+
+	problems, err := findMediaProblems()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if problems == nil {
+		problems = []mediaProblemEntry{}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].ModTime > problems[j].ModTime })
+
+	total := len(problems)
+	offset := pageNo * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + pageSize
+	if end > total {
+		end = total
+	}
+	if end < offset {
+		end = offset
+	}
+
+	finalResp := map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"pageNo": pageNo,
+			"total":  total,
+			"list":   problems[offset:end],
+		},
+		"msg": "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalResp)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A minimal EBML (WebM/Matroska) reader for the probe. It walks the Segment
+// up to the first Cluster, which is where the headers end.
+
+const (
+	ebmlHeaderID     = 0x1A45DFA3
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvDateUTC       = 0x4461
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvTrackType     = 0x83
+	mkvCodecID       = 0x86
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvDisplayWidth  = 0x54B0
+	mkvDisplayHeight = 0x54BA
+	mkvCluster       = 0x1F43B675
+)
+
+type ebmlElement struct {
+	id     uint32
+	offset int64 // start of the data
+	size   int64
+}
+
+// readEBMLVint reads a variable-length integer at off. For ids the length
+// marker is kept; for sizes it is masked off.
+func readEBMLVint(r io.ReaderAt, off int64, keepMarker bool) (uint64, int, error) {
+	var first [1]byte
+	if _, err := r.ReadAt(first[:], off); err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("ebml: invalid variable-length integer")
+	}
+	buf := make([]byte, length)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return 0, 0, err
+	}
+	if !keepMarker {
+		buf[0] &= byte(0xff >> length)
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, length, nil
+}
+
+// readEBMLElements lists the elements between start and end.
+func readEBMLElements(r io.ReaderAt, start, end int64) ([]ebmlElement, error) {
+	var elements []ebmlElement
+	for off := start; off < end; {
+		id, idLen, err := readEBMLVint(r, off, true)
+		if err != nil {
+			return elements, err
+		}
+		size, sizeLen, err := readEBMLVint(r, off+int64(idLen), false)
+		if err != nil {
+			return elements, err
+		}
+		e := ebmlElement{id: uint32(id), offset: off + int64(idLen+sizeLen), size: int64(size)}
+		if size == 1<<(7*uint(sizeLen))-1 {
+			// Unknown size, as in live recordings: extends to the parent's end
+			e.size = end - e.offset
+		}
+		if e.offset+e.size > end {
+			return elements, fmt.Errorf("ebml: element %x at %d exceeds its parent", e.id, off)
+		}
+		elements = append(elements, e)
+		if e.id == mkvCluster {
+			// Headers are done; media data follows
+			break
+		}
+		off = e.offset + e.size
+	}
+	return elements, nil
+}
+
+func readEBMLData(r io.ReaderAt, e ebmlElement) ([]byte, error) {
+	if e.size > 1024 {
+		return nil, fmt.Errorf("ebml: element %x is too large", e.id)
+	}
+	data := make([]byte, e.size)
+	_, err := r.ReadAt(data, e.offset)
+	return data, err
+}
+
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// probeWebM reads the duration and the size of the first video track.
+func probeWebM(r io.ReaderAt, size int64) (*mediaProbe, error) {
+	top, err := readEBMLElements(r, 0, size)
+	if len(top) == 0 || top[0].id != ebmlHeaderID {
+		if err == nil {
+			err = errors.New("ebml: missing EBML header")
+		}
+		return nil, err
+	}
+	var segment *ebmlElement
+	for i := range top {
+		if top[i].id == mkvSegment {
+			segment = &top[i]
+			break
+		}
+	}
+	if segment == nil {
+		return nil, errors.New("ebml: no Segment element")
+	}
+
+	children, err := readEBMLElements(r, segment.offset, segment.offset+segment.size)
+	if err != nil && len(children) == 0 {
+		return nil, err
+	}
+
+	probe := &mediaProbe{Container: "webm"}
+	for _, e := range children {
+		switch e.id {
+		case mkvInfo:
+			scale := 1000000.0
+			var duration float64
+			info, _ := readEBMLElements(r, e.offset, e.offset+e.size)
+			for _, f := range info {
+				data, err := readEBMLData(r, f)
+				if err != nil {
+					continue
+				}
+				switch f.id {
+				case mkvTimecodeScale:
+					scale = float64(ebmlUint(data))
+				case mkvDuration:
+					duration = ebmlFloat(data)
+				case mkvDateUTC:
+					// Nanoseconds since 2001, signed
+					if t := mkvEpoch.Add(time.Duration(int64(ebmlUint(data)))); plausibleCaptureTime(t) {
+						probe.CaptureTime = t
+					}
+				}
+			}
+			probe.Duration = duration * scale / 1e9
+		case mkvTracks:
+			tracks, _ := readEBMLElements(r, e.offset, e.offset+e.size)
+			for _, t := range tracks {
+				if t.id != mkvTrackEntry {
+					continue
+				}
+				probeWebMTrack(r, t, probe)
+			}
+		}
+	}
+	return probe, nil
+}
+
+// probeWebMTrack fills in the size and codec of the first video track and
+// the codec of the first audio track.
+func probeWebMTrack(r io.ReaderAt, track ebmlElement, probe *mediaProbe) {
+	fields, _ := readEBMLElements(r, track.offset, track.offset+track.size)
+	var trackType uint64
+	var codec string
+	var width, height, displayWidth, displayHeight int
+	for _, f := range fields {
+		switch f.id {
+		case mkvTrackType:
+			data, _ := readEBMLData(r, f)
+			trackType = ebmlUint(data)
+		case mkvCodecID:
+			data, _ := readEBMLData(r, f)
+			codec = matroskaCodec(string(data))
+		case mkvVideo:
+			video, _ := readEBMLElements(r, f.offset, f.offset+f.size)
+			for _, v := range video {
+				data, err := readEBMLData(r, v)
+				if err != nil {
+					continue
+				}
+				switch v.id {
+				case mkvPixelWidth:
+					width = int(ebmlUint(data))
+				case mkvPixelHeight:
+					height = int(ebmlUint(data))
+				case mkvDisplayWidth:
+					displayWidth = int(ebmlUint(data))
+				case mkvDisplayHeight:
+					displayHeight = int(ebmlUint(data))
+				}
+			}
+		}
+	}
+	switch trackType {
+	case 1:
+		if probe.Width > 0 || probe.VideoCodec != "" {
+			return
+		}
+		if displayWidth > 0 && displayHeight > 0 {
+			width, height = displayWidth, displayHeight
+		}
+		probe.Width, probe.Height = width, height
+		probe.VideoCodec = codec
+	case 2:
+		if probe.AudioCodec == "" {
+			probe.AudioCodec = codec
+		}
+	}
+}
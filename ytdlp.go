@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ytdlpInfo is the part of a yt-dlp .info.json file used by the scanner.
+type ytdlpInfo struct {
+	ID           string         `json:"id"`
+	Title        string         `json:"title"`
+	Description  string         `json:"description"`
+	UploadDate   string         `json:"upload_date"`
+	Timestamp    float64        `json:"timestamp"`
+	Uploader     string         `json:"uploader"`
+	UploaderID   string         `json:"uploader_id"`
+	ChannelID    string         `json:"channel_id"`
+	LikeCount    int            `json:"like_count"`
+	ViewCount    int            `json:"view_count"`
+	CommentCount int            `json:"comment_count"`
+	RepostCount  int            `json:"repost_count"`
+	Thumbnail    string         `json:"thumbnail"`
+	Comments     []ytdlpComment `json:"comments"`
+}
+
+type ytdlpComment struct {
+	ID              string  `json:"id"`
+	Text            string  `json:"text"`
+	Author          string  `json:"author"`
+	AuthorID        string  `json:"author_id"`
+	AuthorThumbnail string  `json:"author_thumbnail"`
+	Timestamp       float64 `json:"timestamp"`
+	LikeCount       int     `json:"like_count"`
+	Parent          string  `json:"parent"`
+}
+
+var infoCache sidecarCache
+
+// ytdlpThumbnailExts are the extensions yt-dlp --write-thumbnail produces.
+var ytdlpThumbnailExts = []string{".jpg", ".webp", ".png", ".image"}
+
+func infoJSONPath(videoPath string) string {
+	return strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".info.json"
+}
+
+// loadInfoJSON returns the parsed .info.json next to a video, or nil.
+func loadInfoJSON(videoPath string) *ytdlpInfo {
+	info, _ := infoCache.load(infoJSONPath(videoPath), func(path string) (interface{}, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var info ytdlpInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("Failed to parse %s: %v", path, err)
+			return nil, err
+		}
+		return &info, nil
+	}).(*ytdlpInfo)
+	return info
+}
+
+// applyInfoJSON fills a scanned video from its yt-dlp metadata: description,
+// upload time, uploader, statistics and thumbnail.
+func applyInfoJSON(video map[string]interface{}, videoPath string) {
+	info := loadInfoJSON(videoPath)
+	if info == nil {
+		return
+	}
+
+	desc := strings.TrimSpace(info.Title)
+	if d := strings.TrimSpace(info.Description); d != "" && d != desc {
+		if desc == "" {
+			desc = d
+		} else {
+			desc += "\n" + d
+		}
+	}
+	if desc != "" {
+		video["desc"] = desc
+	}
+
+	if info.Timestamp > 0 {
+		video["create_time"] = int64(info.Timestamp)
+	} else if t, err := time.Parse("20060102", info.UploadDate); err == nil {
+		video["create_time"] = t.Unix()
+	}
+
+	uid := info.UploaderID
+	if uid == "" {
+		uid = info.ChannelID
+	}
+	if uid != "" || info.Uploader != "" {
+		if uid == "" {
+			uid = info.Uploader
+		}
+		nickname := info.Uploader
+		if nickname == "" {
+			nickname = uid
+		}
+		video["author"] = newLocalAuthor(uid, nickname, "")
+	}
+
+	if stats, ok := video["statistics"].(map[string]interface{}); ok {
+		stats["digg_count"] = info.LikeCount
+		stats["play_count"] = info.ViewCount
+		stats["comment_count"] = info.CommentCount
+		stats["share_count"] = info.RepostCount
+	}
+
+	// Prefer a thumbnail written next to the video over the remote URL
+	coverUrl := info.Thumbnail
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+	for _, ext := range ytdlpThumbnailExts {
+		if _, err := os.Stat(base + ext); err == nil {
+			if rel, err := filepath.Rel(mediaDir, base+ext); err == nil {
+				coverUrl = mediaURL(rel)
+			}
+			break
+		}
+	}
+	if coverUrl != "" {
+		if v, ok := video["video"].(map[string]interface{}); ok {
+			v["cover"] = map[string]interface{}{
+				"url_list": []string{coverUrl},
+			}
+		}
+	}
+}
+
+// infoJSONCommentsView returns the comments stored in the .info.json of a
+// local video, in the shape of the mock comment files.
+func infoJSONCommentsView(awemeID string) []interface{} {
+	// Mock ids would rescan the media directory on every request
+	if !isMediaID(awemeID) {
+		return nil
+	}
+	path, ok := mediaPathByID(awemeID)
+	if !ok {
+		return nil
+	}
+	info := loadInfoJSON(path)
+	if info == nil {
+		return nil
+	}
+
+	replies := make(map[string]int)
+	for _, c := range info.Comments {
+		if c.Parent != "" && c.Parent != "root" {
+			replies[c.Parent]++
+		}
+	}
+
+	list := make([]interface{}, 0, len(info.Comments))
+	for _, c := range info.Comments {
+		replyID := ""
+		if c.Parent != "root" {
+			replyID = c.Parent
+		}
+		uid := c.AuthorID
+		if uid == "" {
+			uid = c.Author
+		}
+		list = append(list, map[string]interface{}{
+			"comment_id":        c.ID,
+			"create_time":       int64(c.Timestamp),
+			"ip_location":       "",
+			"aweme_id":          awemeID,
+			"content":           c.Text,
+			"reply_id":          replyID,
+			"is_author_digged":  false,
+			"is_folded":         false,
+			"is_hot":            false,
+			"user_buried":       false,
+			"user_digged":       0,
+			"digg_count":        c.LikeCount,
+			"user_id":           uid,
+			"sec_uid":           uid,
+			"short_user_id":     uid,
+			"user_unique_id":    uid,
+			"user_signature":    "",
+			"nickname":          c.Author,
+			"avatar":            c.AuthorThumbnail,
+			"sub_comment_count": replies[c.ID],
+			"last_modify_ts":    int64(c.Timestamp),
+		})
+	}
+	return list
+}